@@ -0,0 +1,252 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type entryFilter struct {
+	keyRegexp   *regexp.Regexp
+	contentType string
+}
+
+func (f entryFilter) match(entry *nginx_cache.Entry) bool {
+	if f.keyRegexp != nil && !f.keyRegexp.MatchString(entry.Key) {
+		return false
+	}
+	if f.contentType != "" {
+		contentType := strings.ToLower(entry.Headers.Get("Content-Type"))
+		if !strings.HasPrefix(contentType, strings.ToLower(f.contentType)) {
+			return false
+		}
+	}
+	return true
+}
+
+type entryOutput struct {
+	Key         string     `json:"key"`
+	Path        string     `json:"path"`
+	Size        int64      `json:"size"`
+	AgeSeconds  int64      `json:"age_seconds"`
+	Status      int        `json:"status"`
+	ContentType string     `json:"content_type"`
+	ValidUntil  *time.Time `json:"valid_until"`
+	Expired     bool       `json:"expired"`
+}
+
+func newEntryOutput(entry *nginx_cache.Entry, now time.Time) entryOutput {
+	out := entryOutput{
+		Key:         entry.Key,
+		Path:        entry.Path,
+		Size:        entry.Size,
+		Status:      entry.Status,
+		ContentType: entry.Headers.Get("Content-Type"),
+		Expired:     entry.Expired(now),
+	}
+	if !entry.Date.IsZero() {
+		out.AgeSeconds = int64(now.Sub(entry.Date).Seconds())
+	}
+	if !entry.ValidSec.IsZero() {
+		validUntil := entry.ValidSec.UTC()
+		out.ValidUntil = &validUntil
+	}
+	return out
+}
+
+// listEntries returns the entries of the cache at cachePath matching filter,
+// sorted by key. Unreadable entries are skipped with a warning.
+func listEntries(cachePath string, filter entryFilter, now time.Time) ([]entryOutput, error) {
+	entries := make([]entryOutput, 0)
+	err := nginx_cache.WalkEntries(cachePath, func(path string, entry *nginx_cache.Entry, err error) error {
+		if err != nil {
+			log.Printf("[warn] skipping %s: %v\n", path, err)
+			return nil
+		}
+		if filter.match(entry) {
+			entries = append(entries, newEntryOutput(entry, now))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache %s: %w", cachePath, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatAge(seconds int64) string {
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func writeTable(w io.Writer, entries []entryOutput) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSIZE\tAGE\tSTATUS\tCONTENT-TYPE\tEXPIRED")
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%t\n", entry.Key, formatSize(entry.Size), formatAge(entry.AgeSeconds), entry.Status, entry.ContentType, entry.Expired)
+	}
+	return tw.Flush()
+}
+
+func writeJSON(w io.Writer, entries []entryOutput) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+func runStats(appName string, cfg *file_config.Config, accessLog string, logFormatName string, format string) error {
+	out := statsOutput{Caches: make([]cacheStats, 0)}
+	for kind, caches := range map[string][]file_config.CacheConfig{"proxy": cfg.ProxyCaches, "fastcgi": cfg.FastcgiCaches} {
+		roots := nginx_cache.LoadCacheRoots(kind)
+		defaultFlags := nginx_cache.ParseCacheDefaultFlags(os.Getenv(strings.ToUpper(kind) + "_CACHE_DEFAULT_FLAGS"))
+		for _, cache := range caches {
+			cachePath, err := nginx_cache.BuildCachePath(kind, appName, cache, roots)
+			if err != nil {
+				return err
+			}
+			stats, err := collectCacheStats(kind, cache, cachePath, defaultFlags)
+			if err != nil {
+				return err
+			}
+			out.Caches = append(out.Caches, stats)
+		}
+	}
+	sort.Slice(out.Caches, func(i, j int) bool {
+		if out.Caches[i].Kind != out.Caches[j].Kind {
+			return out.Caches[i].Kind > out.Caches[j].Kind
+		}
+		return out.Caches[i].Name < out.Caches[j].Name
+	})
+
+	if accessLog != "" {
+		logFormat, err := readLogFormat(logFormatName)
+		if err != nil {
+			return err
+		}
+		if out.AccessLog, err = collectAccessLogStats(accessLog, logFormat); err != nil {
+			return err
+		}
+	}
+
+	if format == "json" {
+		return writeStatsJSON(os.Stdout, out)
+	}
+	writeStatsText(os.Stdout, out, time.Now())
+	return nil
+}
+
+func main() {
+	var (
+		configPath   string
+		appName      string
+		proxyCache   string
+		fastcgiCache string
+		keyRegex     string
+		contentType  string
+		format       string
+		stats        bool
+		accessLog    string
+		logFormat    string
+	)
+
+	flag.StringVar(&configPath, "config", "", "path to nginx config file")
+	flag.StringVar(&appName, "app-name", "", "app name used when rendering the nginx config (optional if cache paths are explicitly set)")
+	flag.StringVar(&proxyCache, "proxy-cache", "", "proxy cache name to inspect")
+	flag.StringVar(&fastcgiCache, "fastcgi-cache", "", "fastcgi cache name to inspect")
+	flag.StringVar(&keyRegex, "key-regex", "", "only list entries whose key matches this regular expression")
+	flag.StringVar(&contentType, "content-type", "", "only list entries whose Content-Type starts with this value")
+	flag.StringVar(&format, "format", "table", "output format: table or json")
+	flag.BoolVar(&stats, "stats", false, "report the size, entries and oldest entry of every cache, and the hit ratios of the access log")
+	flag.StringVar(&accessLog, "access-log", "", "access log of the app, for -stats")
+	flag.StringVar(&logFormat, "log-format-name", "", "log_format of the access log, for -stats (combined by default)")
+	flag.Parse()
+
+	if configPath == "" {
+		log.Fatalln("missing required -config flag")
+	}
+	if !stats && (proxyCache == "") == (fastcgiCache == "") {
+		log.Fatalln("exactly one of -proxy-cache and -fastcgi-cache is required")
+	}
+	if format != "table" && format != "json" {
+		log.Fatalf("invalid -format %q, expected table or json\n", format)
+	}
+
+	filter := entryFilter{contentType: contentType}
+	if keyRegex != "" {
+		re, err := regexp.Compile(keyRegex)
+		if err != nil {
+			log.Fatalln("invalid -key-regex:", err)
+		}
+		filter.keyRegexp = re
+	}
+
+	cfg, _, err := file_config.ReadConfig(configPath)
+	if err != nil {
+		log.Fatalln("error parsing config file:", err)
+	}
+
+	if stats {
+		if err := runStats(appName, cfg, accessLog, logFormat, format); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	kind, name, caches := "proxy", proxyCache, cfg.ProxyCaches
+	if fastcgiCache != "" {
+		kind, name, caches = "fastcgi", fastcgiCache, cfg.FastcgiCaches
+	}
+	var cache *file_config.CacheConfig
+	for i := range caches {
+		if caches[i].Name == name {
+			cache = &caches[i]
+		}
+	}
+	if cache == nil {
+		log.Fatalf("%s cache %q not found in config\n", kind, name)
+	}
+
+	cachePath, err := nginx_cache.BuildCachePath(kind, appName, *cache, nginx_cache.LoadCacheRoots(kind))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	entries, err := listEntries(cachePath, filter, time.Now())
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if format == "json" {
+		err = writeJSON(os.Stdout, entries)
+	} else {
+		err = writeTable(os.Stdout, entries)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cacheStats struct {
+	Kind              string     `json:"kind"`
+	Name              string     `json:"name"`
+	Path              string     `json:"path"`
+	Size              int64      `json:"size"`
+	MaxSize           int64      `json:"max_size"`
+	Entries           int64      `json:"entries"`
+	OldestKey         string     `json:"oldest_key"`
+	OldestDate        *time.Time `json:"oldest_date"`
+	UnreadableEntries int64      `json:"unreadable_entries"`
+}
+
+// cacheStatusStats counts the $upstream_cache_status values of an access log.
+type cacheStatusStats struct {
+	Path     string           `json:"path"`
+	Statuses map[string]int64 `json:"statuses"`
+	Total    int64            `json:"total"`
+	Hit      float64          `json:"hit_ratio"`
+	Miss     float64          `json:"miss_ratio"`
+	Stale    float64          `json:"stale_ratio"`
+}
+
+type statsOutput struct {
+	Caches []cacheStats `json:"caches"`
+	// AccessLog is nil when the log format has no $upstream_cache_status.
+	AccessLog *cacheStatusStats `json:"access_log"`
+}
+
+var nginxSizeRegexp = regexp.MustCompile(`^(\d+)([kKmMgG]?)$`)
+
+// parseNginxSize parses an nginx size such as max_size=10g.
+func parseNginxSize(value string) (int64, error) {
+	match := nginxSizeRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	size, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", value, err)
+	}
+	switch strings.ToLower(match[2]) {
+	case "k":
+		size <<= 10
+	case "m":
+		size <<= 20
+	case "g":
+		size <<= 30
+	}
+	return size, nil
+}
+
+// collectCacheStats walks the cache at cachePath.
+func collectCacheStats(kind string, cache file_config.CacheConfig, cachePath string, defaultFlags map[string]string) (cacheStats, error) {
+	stats := cacheStats{Kind: kind, Name: cache.Name, Path: cachePath}
+
+	maxSize, ok := cache.Flags["max_size"]
+	if !ok {
+		maxSize = defaultFlags["max_size"]
+	}
+	if maxSize != "" {
+		size, err := parseNginxSize(maxSize)
+		if err != nil {
+			return stats, fmt.Errorf("%s cache %q: %w", kind, cache.Name, err)
+		}
+		stats.MaxSize = size
+	}
+
+	err := nginx_cache.WalkEntries(cachePath, func(path string, entry *nginx_cache.Entry, err error) error {
+		if err != nil {
+			stats.UnreadableEntries++
+			return nil
+		}
+		stats.Entries++
+		stats.Size += entry.Size
+		if !entry.Date.IsZero() && (stats.OldestDate == nil || entry.Date.Before(*stats.OldestDate)) {
+			date := entry.Date.UTC()
+			stats.OldestDate = &date
+			stats.OldestKey = entry.Key
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to read cache %s: %w", cachePath, err)
+	}
+	return stats, nil
+}
+
+var logFormatVariableRegexp = regexp.MustCompile(`\$(?:\{([a-z0-9_]+)\}|([a-z0-9_]+))`)
+
+// logFormatStatusRegexp turns a log_format into a regexp capturing
+// $upstream_cache_status, or nil when the format does not log it.
+func logFormatStatusRegexp(format string) *regexp.Regexp {
+	matches := logFormatVariableRegexp.FindAllStringSubmatchIndex(format, -1)
+	expr := "^"
+	last := 0
+	found := false
+	for _, m := range matches {
+		expr += regexp.QuoteMeta(format[last:m[0]])
+		var name string
+		if m[2] >= 0 {
+			name = format[m[2]:m[3]]
+		} else {
+			name = format[m[4]:m[5]]
+		}
+		if name == "upstream_cache_status" && !found {
+			expr += "(?P<status>[A-Z-]*)"
+			found = true
+		} else {
+			expr += ".*?"
+		}
+		last = m[1]
+	}
+	if !found {
+		return nil
+	}
+	return regexp.MustCompile(expr + regexp.QuoteMeta(format[last:]) + "$")
+}
+
+// findLogFormat returns the log_format named name in the output of nginx -T.
+func findLogFormat(nginxConfig string, name string) (string, bool) {
+	re := regexp.MustCompile(`(?m)^\s*log_format\s+` + regexp.QuoteMeta(name) + `\s+`)
+	loc := re.FindStringIndex(nginxConfig)
+	if loc == nil {
+		return "", false
+	}
+
+	format := ""
+	rest := nginxConfig[loc[1]:]
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; c {
+		case ';':
+			return format, true
+		case '\'', '"':
+			end := strings.IndexByte(rest[i+1:], c)
+			if end < 0 {
+				return "", false
+			}
+			format += rest[i+1 : i+1+end]
+			i += end + 1
+		case ' ', '\t', '\n', '\r':
+		default:
+			end := strings.IndexAny(rest[i:], " \t\r\n;")
+			if end < 0 {
+				return "", false
+			}
+			if token := rest[i : i+end]; !strings.HasPrefix(token, "escape=") {
+				format += token
+			}
+			i += end - 1
+		}
+	}
+	return "", false
+}
+
+// nginxBinaries are the binaries the plugin runs nginx with, openresty first
+// as it is used whenever installed. The inspector runs as root through sudo,
+// so the binary is never taken from the caller.
+var nginxBinaries = []string{"/usr/bin/openresty", "/usr/sbin/nginx"}
+
+// findNginxBinary returns the first executable of nginxBinaries.
+func findNginxBinary() (string, error) {
+	for _, path := range nginxBinaries {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0o111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("nginx not found at %s", strings.Join(nginxBinaries, " or "))
+}
+
+// readLogFormat resolves a log_format name from the running nginx config.
+func readLogFormat(name string) (string, error) {
+	if name == "" || name == "combined" {
+		return `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`, nil
+	}
+	nginxBin, err := findNginxBinary()
+	if err != nil {
+		return "", err
+	}
+	output, err := exec.Command(nginxBin, "-T").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to dump nginx config: %w", err)
+	}
+	format, ok := findLogFormat(string(output), name)
+	if !ok {
+		return "", fmt.Errorf("log_format %q not found in nginx config", name)
+	}
+	return format, nil
+}
+
+// countCacheStatuses counts the cache statuses of the access log lines
+// matching re. Requests that didn't go through a cache log "-" and are
+// skipped.
+func countCacheStatuses(r io.Reader, re *regexp.Regexp) (*cacheStatusStats, error) {
+	stats := &cacheStatusStats{Statuses: make(map[string]int64)}
+	statusIndex := re.SubexpIndex("status")
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		match := re.FindStringSubmatch(scanner.Text())
+		if match == nil || match[statusIndex] == "" || match[statusIndex] == "-" {
+			continue
+		}
+		stats.Statuses[match[statusIndex]]++
+		stats.Total++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if stats.Total > 0 {
+		ratio := func(statuses ...string) float64 {
+			var n int64
+			for _, status := range statuses {
+				n += stats.Statuses[status]
+			}
+			return float64(n) / float64(stats.Total)
+		}
+		stats.Hit = ratio("HIT", "REVALIDATED")
+		stats.Miss = ratio("MISS", "EXPIRED", "BYPASS")
+		stats.Stale = ratio("STALE", "UPDATING")
+	}
+	return stats, nil
+}
+
+func collectAccessLogStats(accessLog string, logFormat string) (*cacheStatusStats, error) {
+	re := logFormatStatusRegexp(logFormat)
+	if re == nil {
+		log.Println("[info] the access log format has no $upstream_cache_status, skipping hit ratios")
+		return nil, nil
+	}
+	f, err := os.Open(accessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	defer f.Close()
+	stats, err := countCacheStatuses(f, re)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access log %s: %w", accessLog, err)
+	}
+	stats.Path = accessLog
+	return stats, nil
+}
+
+func writeStatsText(w io.Writer, stats statsOutput, now time.Time) {
+	for _, cache := range stats.Caches {
+		fmt.Fprintf(w, "%s cache %s (%s)\n", cache.Kind, cache.Name, cache.Path)
+		if cache.MaxSize > 0 {
+			fmt.Fprintf(w, "  size:    %s / %s (%.1f%%)\n", formatSize(cache.Size), formatSize(cache.MaxSize), float64(cache.Size)*100/float64(cache.MaxSize))
+		} else {
+			fmt.Fprintf(w, "  size:    %s (no max_size)\n", formatSize(cache.Size))
+		}
+		fmt.Fprintf(w, "  entries: %d\n", cache.Entries)
+		if cache.UnreadableEntries > 0 {
+			fmt.Fprintf(w, "  unreadable entries: %d\n", cache.UnreadableEntries)
+		}
+		if cache.OldestDate != nil {
+			fmt.Fprintf(w, "  oldest:  %s (%s ago) %s\n", cache.OldestDate.Format(time.RFC3339), now.Sub(*cache.OldestDate).Round(time.Second), cache.OldestKey)
+		}
+	}
+	if stats.AccessLog == nil {
+		return
+	}
+	fmt.Fprintf(w, "access log %s: %d cached requests\n", stats.AccessLog.Path, stats.AccessLog.Total)
+	if stats.AccessLog.Total > 0 {
+		fmt.Fprintf(w, "  hit: %.1f%%  miss: %.1f%%  stale: %.1f%%\n", stats.AccessLog.Hit*100, stats.AccessLog.Miss*100, stats.AccessLog.Stale*100)
+	}
+}
+
+func writeStatsJSON(w io.Writer, stats statsOutput) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(stats)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+)
+
+func writeTestCacheEntry(t *testing.T, path string, key string, date time.Time, body string) {
+	t.Helper()
+	head := make([]byte, nginx_cache.HeaderSize)
+	keyLine := "\nKEY: " + key + "\n"
+	headers := "HTTP/1.1 200 OK\r\n\r\n"
+	headerStart := nginx_cache.HeaderSize + len(keyLine)
+	binary.LittleEndian.PutUint64(head[0:8], nginx_cache.Version)
+	binary.LittleEndian.PutUint64(head[40:48], uint64(date.Unix()))
+	binary.LittleEndian.PutUint16(head[54:56], uint16(headerStart))
+	binary.LittleEndian.PutUint16(head[56:58], uint16(headerStart+len(headers)))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(append(append(head, keyLine...), headers...), body...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectCacheStats(t *testing.T) {
+	cachePath := t.TempDir()
+	date := time.Unix(1700000000, 0)
+	writeTestCacheEntry(t, filepath.Join(cachePath, "c", "29", "b7f54b2df7773722d382f4809d65029c"), "httpsexample.com/new", date, "new")
+	writeTestCacheEntry(t, filepath.Join(cachePath, "d", "6f", "a6bf1757fff057f266b697df9cf176fd"), "httpsexample.com/old", date.Add(-time.Hour), "old")
+
+	stats, err := collectCacheStats("proxy", file_config.CacheConfig{Name: "pages"}, cachePath, nginx_cache.ParseCacheDefaultFlags("levels=1:2 max_size=1g"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Entries != 2 || stats.Size == 0 || stats.MaxSize != 1<<30 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.OldestKey != "httpsexample.com/old" || !stats.OldestDate.Equal(date.Add(-time.Hour)) {
+		t.Fatalf("unexpected oldest entry %s at %s", stats.OldestKey, stats.OldestDate)
+	}
+
+	stats, err = collectCacheStats("proxy", file_config.CacheConfig{Name: "pages", Flags: map[string]string{"max_size": "500m"}}, filepath.Join(cachePath, "missing"), nil)
+	if err != nil || stats.Entries != 0 || stats.MaxSize != 500<<20 {
+		t.Fatalf("unexpected stats %+v, %v", stats, err)
+	}
+}
+
+func TestParseNginxSize(t *testing.T) {
+	for value, expected := range map[string]int64{"1024": 1024, "10k": 10 << 10, "2M": 2 << 20, "1g": 1 << 30} {
+		if size, err := parseNginxSize(value); err != nil || size != expected {
+			t.Fatalf("expected %s to be %d, got %d, %v", value, expected, size, err)
+		}
+	}
+	if _, err := parseNginxSize("1t"); err == nil {
+		t.Fatal("expected an invalid size to be rejected")
+	}
+}
+
+func TestAccessLogCacheStatuses(t *testing.T) {
+	nginxConfig := `# configuration file /etc/nginx/nginx.conf:
+http {
+    log_format main '$remote_addr [$time_local] "$request" $status';
+    log_format cache escape=json '$remote_addr [$time_local] "$request" '
+                     '$status cache=$upstream_cache_status "${http_user_agent}"';
+}
+`
+	format, ok := findLogFormat(nginxConfig, "cache")
+	if !ok {
+		t.Fatal("expected the cache log format to be found")
+	}
+	if format != `$remote_addr [$time_local] "$request" $status cache=$upstream_cache_status "${http_user_agent}"` {
+		t.Fatalf("unexpected format %q", format)
+	}
+	if _, ok := findLogFormat(nginxConfig, "missing"); ok {
+		t.Fatal("expected a missing log format not to be found")
+	}
+
+	mainFormat, _ := findLogFormat(nginxConfig, "main")
+	if logFormatStatusRegexp(mainFormat) != nil {
+		t.Fatal("expected a format without $upstream_cache_status to be skipped")
+	}
+
+	accessLog := strings.Join([]string{
+		`203.0.113.1 [18/Oct/2026:10:00:00 +0000] "GET / HTTP/1.1" 200 cache=HIT "curl"`,
+		`203.0.113.1 [18/Oct/2026:10:00:01 +0000] "GET / HTTP/1.1" 200 cache=HIT "curl"`,
+		`203.0.113.1 [18/Oct/2026:10:00:02 +0000] "GET /a HTTP/1.1" 200 cache=MISS "curl"`,
+		`203.0.113.1 [18/Oct/2026:10:00:03 +0000] "GET /b HTTP/1.1" 200 cache=STALE "curl"`,
+		`203.0.113.1 [18/Oct/2026:10:00:04 +0000] "GET /api HTTP/1.1" 200 cache=- "curl"`,
+		`not an access log line`,
+	}, "\n")
+	stats, err := countCacheStatuses(strings.NewReader(accessLog), logFormatStatusRegexp(format))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Total != 4 || stats.Hit != 0.5 || stats.Miss != 0.25 || stats.Stale != 0.25 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReadLogFormat(t *testing.T) {
+	dir := t.TempDir()
+	nginxBin := filepath.Join(dir, "nginx")
+	script := "#!/bin/sh\n[ \"$1\" = -T ] || exit 1\ncat <<'EOF'\nhttp {\n    log_format cache '$status $upstream_cache_status';\n}\nEOF\n"
+	if err := os.WriteFile(nginxBin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defaultBinaries := nginxBinaries
+	t.Cleanup(func() { nginxBinaries = defaultBinaries })
+
+	t.Run("Combined", func(t *testing.T) {
+		nginxBinaries = nil
+		format, err := readLogFormat("")
+		if err != nil || !strings.HasPrefix(format, "$remote_addr - $remote_user") {
+			t.Errorf("expected the combined format without running nginx, got %q, %v", format, err)
+		}
+	})
+
+	t.Run("FirstInstalledBinary", func(t *testing.T) {
+		nginxBinaries = []string{filepath.Join(dir, "openresty"), nginxBin}
+		format, err := readLogFormat("cache")
+		if err != nil || format != "$status $upstream_cache_status" {
+			t.Errorf("unexpected format %q, %v", format, err)
+		}
+	})
+
+	t.Run("NoBinary", func(t *testing.T) {
+		nginxBinaries = []string{filepath.Join(dir, "openresty")}
+		if _, err := readLogFormat("cache"); err == nil {
+			t.Errorf("expected an error without nginx")
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultCacheKeyFormat = "$scheme$host$request_uri"
+
+// cacheEntryHeaderSize bounds how much of a cache file is read to find its
+// KEY line, which nginx writes right after the binary header.
+const cacheEntryHeaderSize = 4096
+
+var cacheKeyVariableRegexp = regexp.MustCompile(`\$(\{[a-z0-9_]+\}|[a-z0-9_]+)`)
+
+// cacheFlags returns the flags the cache path was declared with.
+func cacheFlags(defaults map[string]string, cache file_config.CacheConfig) map[string]string {
+	flags := make(map[string]string, len(defaults)+len(cache.Flags))
+	for k, v := range defaults {
+		flags[k] = v
+	}
+	for k, v := range cache.Flags {
+		flags[k] = v
+	}
+	return flags
+}
+
+// parseCacheLevels parses the levels= flag of a cache path. A cache without
+// levels stores its files at the root of the cache directory.
+func parseCacheLevels(flags map[string]string) ([]int, error) {
+	value, ok := flags["levels"]
+	if !ok || value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid levels %q: at most 3 levels are allowed", value)
+	}
+	levels := make([]int, 0, len(parts))
+	for _, part := range parts {
+		level, err := strconv.Atoi(part)
+		if err != nil || level < 1 || level > 2 {
+			return nil, fmt.Errorf("invalid levels %q: each level must be 1 or 2", value)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// cacheEntryPath returns the file nginx stores key in: the MD5 of the key,
+// in directories named after its last characters.
+func cacheEntryPath(cachePath string, levels []int, key string) string {
+	sum := md5.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+
+	parts := []string{cachePath}
+	end := len(name)
+	for _, level := range levels {
+		parts = append(parts, name[end-level:end])
+		end -= level
+	}
+	parts = append(parts, name)
+	return filepath.Join(parts...)
+}
+
+// cacheKeyFromURL builds the cache key of a URL following format, which must
+// match the proxy_cache_key or fastcgi_cache_key of the location.
+func cacheKeyFromURL(format string, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid url %q: scheme and host are required", rawURL)
+	}
+
+	isArgs := ""
+	if u.RawQuery != "" {
+		isArgs = "?"
+	}
+	values := map[string]string{
+		"scheme":       u.Scheme,
+		"host":         strings.ToLower(u.Hostname()),
+		"http_host":    u.Host,
+		"request_uri":  u.RequestURI(),
+		"uri":          u.Path,
+		"args":         u.RawQuery,
+		"query_string": u.RawQuery,
+		"is_args":      isArgs,
+	}
+	if values["uri"] == "" {
+		values["uri"] = "/"
+	}
+
+	var unknown []string
+	key := cacheKeyVariableRegexp.ReplaceAllStringFunc(format, func(variable string) string {
+		name := strings.Trim(variable, "${}")
+		value, ok := values[name]
+		if argName, isArg := strings.CutPrefix(name, "arg_"); isArg {
+			value, ok = queryArg(u.RawQuery, argName), true
+		}
+		if !ok {
+			unknown = append(unknown, variable)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("cache key format %q uses variables that can't be derived from a url: %s", format, strings.Join(unknown, ", "))
+	}
+	return key, nil
+}
+
+// queryArg returns the raw value of the first query argument named name,
+// compared case-insensitively like nginx $arg_name.
+func queryArg(rawQuery string, name string) string {
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if key, value, _ := strings.Cut(pair, "="); strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// purgeCacheEntry removes the cache file of key. It returns false when the key
+// is not cached, and refuses to remove a file stored for another key.
+func purgeCacheEntry(entryPath string, key string) (bool, error) {
+	f, err := os.Open(entryPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open cache entry %s: %w", entryPath, err)
+	}
+	header := make([]byte, cacheEntryHeaderSize+len(key))
+	n, err := io.ReadFull(f, header)
+	f.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("failed to read cache entry %s: %w", entryPath, err)
+	}
+	if !bytes.Contains(header[:n], []byte("\nKEY: "+key+"\n")) {
+		return false, fmt.Errorf("cache entry %s does not hold key %q", entryPath, key)
+	}
+
+	if err := os.Remove(entryPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to remove cache entry %s: %w", entryPath, err)
+	}
+	log.Printf("Removed cache entry %s\n", entryPath)
+	return true, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+)
+
+func TestParseCacheLevels(t *testing.T) {
+	defaults := nginx_cache.ParseCacheDefaultFlags("levels=1:2 inactive=60m use_temp_path=off")
+	levels, err := parseCacheLevels(cacheFlags(defaults, file_config.CacheConfig{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(levels) != 2 || levels[0] != 1 || levels[1] != 2 {
+		t.Fatalf("expected levels [1 2], got %v", levels)
+	}
+
+	levels, err = parseCacheLevels(cacheFlags(defaults, file_config.CacheConfig{Flags: map[string]string{"levels": "2"}}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(levels) != 1 || levels[0] != 2 {
+		t.Fatalf("expected cache flags to override default levels, got %v", levels)
+	}
+
+	for _, invalid := range []string{"3", "1:2:2:1", "a:b"} {
+		if _, err := parseCacheLevels(map[string]string{"levels": invalid}); err == nil {
+			t.Fatalf("expected levels %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestCacheEntryPath(t *testing.T) {
+	// md5("http://example.com/") = a6bf1757fff057f266b697df9cf176fd
+	key := "http://example.com/"
+	if got := cacheEntryPath("/cache", []int{1, 2}, key); got != "/cache/d/6f/a6bf1757fff057f266b697df9cf176fd" {
+		t.Fatalf("unexpected entry path %s", got)
+	}
+	if got := cacheEntryPath("/cache", nil, key); got != "/cache/a6bf1757fff057f266b697df9cf176fd" {
+		t.Fatalf("unexpected entry path %s", got)
+	}
+}
+
+func TestCacheKeyFromURL(t *testing.T) {
+	key, err := cacheKeyFromURL(defaultCacheKeyFormat, "https://Example.com:8443/blog/post?page=2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "httpsexample.com/blog/post?page=2" {
+		t.Fatalf("unexpected key %q", key)
+	}
+
+	key, err = cacheKeyFromURL("${scheme}://$http_host$uri$is_args$args", "http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "http://example.com/" {
+		t.Fatalf("unexpected key %q", key)
+	}
+
+	// variable names may contain digits
+	key, err = cacheKeyFromURL("$host$uri$arg_v2", "https://example.com/api?v=1&V2=beta")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key != "example.com/apibeta" {
+		t.Fatalf("unexpected key %q", key)
+	}
+	if _, err := cacheKeyFromURL("$host$uri$http_x_v2", "https://example.com/api"); err == nil || !strings.Contains(err.Error(), "$http_x_v2") {
+		t.Fatalf("expected $http_x_v2 to be rejected as a whole, got %v", err)
+	}
+
+	if _, err := cacheKeyFromURL("$scheme$proxy_host$request_uri", "http://example.com/"); err == nil {
+		t.Fatal("expected $proxy_host to be rejected")
+	}
+	if _, err := cacheKeyFromURL(defaultCacheKeyFormat, "/relative"); err == nil {
+		t.Fatal("expected a relative url to be rejected")
+	}
+}
+
+func TestPurgeCacheEntry(t *testing.T) {
+	key := "httpsexample.com/"
+	entryPath := cacheEntryPath(t.TempDir(), []int{1, 2}, key)
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := purgeCacheEntry(entryPath, key)
+	if err != nil || removed {
+		t.Fatalf("expected a missing entry to be skipped, got %v, %v", removed, err)
+	}
+
+	if err := os.WriteFile(entryPath, []byte("\x05\x00\x00\x00binary header\nKEY: httpsexample.com/other\nHTTP/1.1 200 OK\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := purgeCacheEntry(entryPath, key); err == nil {
+		t.Fatal("expected an entry of another key to be kept")
+	}
+
+	if err := os.WriteFile(entryPath, []byte("\x05\x00\x00\x00binary header\nKEY: httpsexample.com/\nHTTP/1.1 200 OK\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	removed, err = purgeCacheEntry(entryPath, key)
+	if err != nil || !removed {
+		t.Fatalf("expected the entry to be removed, got %v, %v", removed, err)
+	}
+	if _, err := os.Stat(entryPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed", entryPath)
+	}
+}
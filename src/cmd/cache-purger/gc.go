@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// gcApp describes an app to the cache gc, one JSON object per line.
+type gcApp struct {
+	App          string            `json:"app"`
+	Config       string            `json:"config"`
+	ProxyRoots   map[string]string `json:"proxy_roots"`
+	FastcgiRoots map[string]string `json:"fastcgi_roots"`
+	// CurrentRelease is the deployed config directory, whose cache paths are
+	// in use even if the config file changed since.
+	CurrentRelease string `json:"current_release"`
+}
+
+// cacheDirNameRegexp matches the cache directories the config builder
+// derives, along with their tag index and tombstones. App names can't
+// contain underscores.
+var cacheDirNameRegexp = regexp.MustCompile(`^(proxy|fastcgi)_([a-z0-9-]+)_[^/]+$`)
+
+var cachePathDirectiveRegexp = regexp.MustCompile(`(?m)^\s*(?:proxy|fastcgi)_cache_path\s+(\S+)`)
+
+func readGcApps(r io.Reader) ([]gcApp, error) {
+	apps := make([]gcApp, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		app := gcApp{}
+		if err := json.Unmarshal([]byte(line), &app); err != nil {
+			return nil, fmt.Errorf("invalid gc app %q: %w", line, err)
+		}
+		apps = append(apps, app)
+	}
+	return apps, scanner.Err()
+}
+
+// cacheBasePath strips the tag index and tombstone suffixes of a path.
+func cacheBasePath(path string) string {
+	if i := strings.Index(path, tombstoneSuffix); i >= 0 {
+		return path[:i]
+	}
+	for _, suffix := range []string{".tag-index.tmp", ".tag-index"} {
+		if strings.HasSuffix(path, suffix) {
+			return strings.TrimSuffix(path, suffix)
+		}
+	}
+	return path
+}
+
+type gcReferences struct {
+	paths map[string]bool
+	// apps whose config could not be read: their directories are all kept
+	unknownApps map[string]bool
+}
+
+func (r gcReferences) referenced(path string) bool {
+	base := cacheBasePath(path)
+	if r.paths[base] {
+		return true
+	}
+	match := cacheDirNameRegexp.FindStringSubmatch(filepath.Base(base))
+	return match != nil && r.unknownApps[match[2]]
+}
+
+// collectGcReferences returns the cache paths referenced by the config and
+// the current release of every app, and the roots to scan.
+func collectGcReferences(apps []gcApp) (gcReferences, []string) {
+	refs := gcReferences{paths: make(map[string]bool), unknownApps: make(map[string]bool)}
+	rootSet := make(map[string]bool)
+	for _, app := range apps {
+		for _, roots := range []map[string]string{app.ProxyRoots, app.FastcgiRoots} {
+			for _, root := range roots {
+				if root != "" {
+					rootSet[filepath.Clean(root)] = true
+				}
+			}
+		}
+
+		if app.CurrentRelease != "" {
+			for _, filename := range []string{"proxy_caches.conf", "fastcgi_caches.conf"} {
+				content, err := os.ReadFile(filepath.Join(app.CurrentRelease, filename))
+				if err != nil {
+					if !errors.Is(err, fs.ErrNotExist) {
+						log.Printf("[warn] app %s: keeping all its caches, failed to read %s: %v\n", app.App, filename, err)
+						refs.unknownApps[app.App] = true
+					}
+					continue
+				}
+				for _, match := range cachePathDirectiveRegexp.FindAllStringSubmatch(string(content), -1) {
+					refs.paths[filepath.Clean(match[1])] = true
+				}
+			}
+		}
+
+		if app.Config == "" {
+			continue
+		}
+		cfg, _, err := file_config.ReadConfig(app.Config)
+		if err != nil {
+			log.Printf("[warn] app %s: keeping all its caches, failed to read config: %v\n", app.App, err)
+			refs.unknownApps[app.App] = true
+			continue
+		}
+		for kind, caches := range map[string][]file_config.CacheConfig{"proxy": cfg.ProxyCaches, "fastcgi": cfg.FastcgiCaches} {
+			roots := app.ProxyRoots
+			if kind == "fastcgi" {
+				roots = app.FastcgiRoots
+			}
+			for _, cache := range caches {
+				cachePath, err := nginx_cache.BuildCachePath(kind, app.App, cache, roots)
+				if err != nil {
+					log.Printf("[warn] app %s: keeping all its caches: %v\n", app.App, err)
+					refs.unknownApps[app.App] = true
+					continue
+				}
+				refs.paths[filepath.Clean(cachePath)] = true
+			}
+		}
+	}
+
+	roots := make([]string, 0, len(rootSet))
+	for root := range rootSet {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return refs, roots
+}
+
+type orphanedCacheDir struct {
+	path string
+	size int64
+}
+
+// dirSize returns the size of the files under path. Files it fails to read
+// are logged and left out.
+func dirSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(walkPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("[warn] failed to size %s, reported size is partial: %v\n", walkPath, err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("[warn] failed to size %s, reported size is partial: %v\n", walkPath, err)
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size
+}
+
+// findOrphanedCacheDirs returns the cache directories under roots that no app
+// references.
+func findOrphanedCacheDirs(roots []string, refs gcReferences) ([]orphanedCacheDir, error) {
+	orphans := make([]orphanedCacheDir, 0)
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache root %s: %w", root, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || !cacheDirNameRegexp.MatchString(entry.Name()) {
+				continue
+			}
+			path := filepath.Join(root, entry.Name())
+			if refs.referenced(path) {
+				continue
+			}
+			orphans = append(orphans, orphanedCacheDir{path: path, size: dirSize(path)})
+		}
+	}
+	return orphans, nil
+}
+
+// removeAll is os.RemoveAll, replaced in tests.
+var removeAll = os.RemoveAll
+
+// gcCaches reports the orphaned cache directories on out, and deletes them
+// with force. A failed deletion doesn't stop the others; the result only
+// counts the directories actually deleted, and the errors are returned
+// together.
+func gcCaches(apps []gcApp, force bool, out io.Writer) (purgeResult, error) {
+	refs, roots := collectGcReferences(apps)
+	orphans, err := findOrphanedCacheDirs(roots, refs)
+	if err != nil {
+		return purgeResult{}, err
+	}
+
+	var result purgeResult
+	var errs []error
+	for _, orphan := range orphans {
+		fmt.Fprintf(out, "%s\t%d\n", orphan.path, orphan.size)
+		if force {
+			if err := removeAll(orphan.path); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete orphaned cache dir %s: %w", orphan.path, err))
+				continue
+			}
+		}
+		result.add(purgeResult{files: 1, bytes: orphan.size})
+	}
+	return result, errors.Join(errs...)
+}
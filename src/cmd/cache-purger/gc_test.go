@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGcCaches(t *testing.T) {
+	dir := t.TempDir()
+	onDisk := filepath.Join(dir, "on_disk")
+	inMem := filepath.Join(dir, "in_mem")
+	release := filepath.Join(dir, "release")
+
+	config := filepath.Join(dir, "myapp.yaml")
+	if err := os.WriteFile(config, []byte(`proxy_caches:
+  - name: pages
+  - name: fragments
+    in_mem: true
+vhosts:
+  - server_name: example.com
+    locations:
+      - uri: /
+        body: proxy_cache {{ .proxy_caches.pages }};
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(release, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// renamed in the config, but not deployed yet
+	if err := os.WriteFile(filepath.Join(release, "proxy_caches.conf"), []byte("proxy_cache_path "+filepath.Join(onDisk, "proxy_myapp_live")+" keys_zone=proxy_myapp_live:10m;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := []string{
+		filepath.Join(onDisk, "proxy_myapp_pages"),
+		filepath.Join(onDisk, "proxy_myapp_pages.tag-index"),
+		filepath.Join(onDisk, "proxy_myapp_pages.tombstone-1700000000"),
+		filepath.Join(inMem, "proxy_myapp_fragments"),
+		filepath.Join(onDisk, "proxy_myapp_live"),
+		filepath.Join(onDisk, "proxy_broken_pages"),
+		filepath.Join(onDisk, "lost+found"),
+	}
+	orphaned := []string{
+		filepath.Join(onDisk, "proxy_myapp_old"),
+		filepath.Join(onDisk, "proxy_myapp_old.tombstone-1700000000"),
+		filepath.Join(inMem, "proxy_myapp_pages"),
+		filepath.Join(onDisk, "proxy_deleted_pages"),
+		filepath.Join(onDisk, "fastcgi_myapp_php"),
+	}
+	for _, path := range append(append([]string{}, kept...), orphaned...) {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(onDisk, "proxy_myapp_old", "entry"), []byte("12345"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := map[string]string{"in_mem": inMem, "on_disk": onDisk}
+	apps, err := readGcApps(strings.NewReader(`{"app":"myapp","config":"` + config + `","proxy_roots":{"in_mem":"` + inMem + `","on_disk":"` + onDisk + `"},"fastcgi_roots":{"on_disk":"` + onDisk + `"},"current_release":"` + release + `"}
+{"app":"broken","config":"` + filepath.Join(dir, "missing.yaml") + `"}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(apps) != 2 || apps[0].ProxyRoots["on_disk"] != roots["on_disk"] {
+		t.Fatalf("unexpected apps %+v", apps)
+	}
+
+	out := &bytes.Buffer{}
+	result, err := gcCaches(apps, false, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.files != int64(len(orphaned)) || result.bytes != 5 {
+		t.Fatalf("unexpected result %+v, output: %s", result, out.String())
+	}
+	for _, path := range orphaned {
+		if !strings.Contains(out.String(), path+"\t") {
+			t.Fatalf("expected %s to be reported, got: %s", path, out.String())
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept without force", path)
+		}
+	}
+
+	if _, err := gcCaches(apps, true, &bytes.Buffer{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range orphaned {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be deleted", path)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept", path)
+		}
+	}
+}
+
+func TestGcCachesDeleteErrors(t *testing.T) {
+	root := t.TempDir()
+	failing := filepath.Join(root, "proxy_myapp_failing")
+	deleted := []string{filepath.Join(root, "proxy_myapp_a"), filepath.Join(root, "proxy_myapp_b")}
+	for _, path := range append([]string{failing}, deleted...) {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "entry"), []byte("123"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeAll = func(path string) error {
+		if path == failing {
+			return errors.New("device busy")
+		}
+		return os.RemoveAll(path)
+	}
+	defer func() { removeAll = os.RemoveAll }()
+
+	apps := []gcApp{{App: "myapp", ProxyRoots: map[string]string{"on_disk": root}}}
+	result, err := gcCaches(apps, true, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), failing) {
+		t.Fatalf("expected an error for %s, got %v", failing, err)
+	}
+	if result.files != 2 || result.bytes != 6 {
+		t.Fatalf("expected only the deleted directories to be counted, got %+v", result)
+	}
+	for _, path := range deleted {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be deleted past the failure", path)
+		}
+	}
+}
@@ -2,23 +2,17 @@ package main
 
 import (
 	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
-func mustEnv(name string) string {
-	value := os.Getenv(name)
-	if value == "" {
-		log.Fatalf("missing required env var: %s", name)
-	}
-	return value
-}
-
 func parseCSVFlag(value string) []string {
 	value = strings.TrimSpace(value)
 	if value == "" {
@@ -56,63 +50,26 @@ func ensureCacheNameExists(cfgCaches []file_config.CacheConfig, requested []stri
 	return selected, nil
 }
 
-func buildCachePath(kind string, appName string, cache file_config.CacheConfig, roots map[string]string) (string, error) {
-	if cache.CachePath != "" {
-		return cache.CachePath, nil
-	}
-
-	if appName == "" {
-		return "", fmt.Errorf("cache %q: app name is required to derive cache path; set -app-name or APP_NAME/DOKKU_APP_NAME", cache.Name)
-	}
-
-	var root string
-	switch {
-	case cache.InMem:
-		root = roots["in_mem"]
-	case cache.OnDisk:
-		root = roots["on_disk"]
-	default:
-		// follow builder default: prefer on_disk when unspecified
-		root = roots["on_disk"]
-	}
-
-	if root == "" {
-		return "", fmt.Errorf("cache %q: missing cache root path for %s caches", cache.Name, kind)
-	}
-
-	prefix := "proxy"
-	if kind == "fastcgi" {
-		prefix = "fastcgi"
-	}
-
-	cacheDirName := fmt.Sprintf("%s_%s_%s", prefix, appName, cache.Name)
-	return filepath.Join(root, cacheDirName), nil
-}
-
-func loadCacheRoots(kind string, needed bool) map[string]string {
-	if !needed {
-		return nil
-	}
-
-	if kind == "proxy" {
-		return map[string]string{
-			"in_mem":  mustEnv("PROXY_CACHE_IN_MEM_ROOT_PATH"),
-			"on_disk": mustEnv("PROXY_CACHE_ON_DISK_ROOT_PATH"),
-		}
-	}
-
-	return map[string]string{
-		"in_mem":  mustEnv("FASTCGI_CACHE_IN_MEM_ROOT_PATH"),
-		"on_disk": mustEnv("FASTCGI_CACHE_ON_DISK_ROOT_PATH"),
-	}
-}
-
+// purgeCacheDir empties a cache directory. Without purgeCommand, the directory
+// is swapped for an empty one and deleted in the background, along with the
+// tombstones of previous purges.
 func purgeCacheDir(path string, purgeCommand string) error {
 	if path == "" || path == "/" {
 		return fmt.Errorf("refusing to remove unsafe path %q", path)
 	}
+	// the tag index only lists files of the purged cache
+	if err := os.RemoveAll(tagIndexPath(path)); err != nil {
+		return fmt.Errorf("failed to remove tag index of %s: %w", path, err)
+	}
 	if purgeCommand == "" {
-		return os.RemoveAll(path)
+		if _, err := tombstoneCacheDir(path, time.Now()); err != nil {
+			return err
+		}
+		tombstones, err := cacheTombstones(path)
+		if err != nil || len(tombstones) == 0 {
+			return err
+		}
+		return spawnTombstoneDeleter(path)
 	}
 	purgeCommands := strings.Split(purgeCommand, " ")
 	purgeCommands = append(purgeCommands, path)
@@ -125,6 +82,29 @@ func purgeCacheDir(path string, purgeCommand string) error {
 	return nil
 }
 
+// purgeCacheKey removes the entry of key from a cache, leaving the rest of the
+// cache warm.
+func purgeCacheKey(kind string, appName string, cache file_config.CacheConfig, roots map[string]string, defaultFlags map[string]string, key string) error {
+	cachePath, err := nginx_cache.BuildCachePath(kind, appName, cache, roots)
+	if err != nil {
+		return err
+	}
+	levels, err := parseCacheLevels(cacheFlags(defaultFlags, cache))
+	if err != nil {
+		return err
+	}
+	entryPath := cacheEntryPath(cachePath, levels, key)
+	log.Printf("Purging key %q from %s cache %q at %s\n", key, kind, cache.Name, entryPath)
+	removed, err := purgeCacheEntry(entryPath, key)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		log.Printf("Key %q is not cached\n", key)
+	}
+	return nil
+}
+
 func main() {
 	var (
 		configPath      string
@@ -132,6 +112,25 @@ func main() {
 		fastcgiFlag     string
 		appName         string
 		purgeCommand    string
+		purgeKey        string
+		purgeURL        string
+		cacheKeyFormat  string
+		purgePrefix     string
+		purgeRegex      string
+		dryRun          bool
+		workers         int
+		purgeTagValue   string
+		useTagIndex     bool
+		rebuildTagIndex bool
+		tagIndexMaxAge  time.Duration
+		tombstonesOf    string
+		gc              bool
+		gcAppsPath      string
+		force           bool
+		onChangeProxy   string
+		onChangeFastcgi string
+		manifestPath    string
+		purgedPath      string
 	)
 
 	flag.StringVar(&configPath, "config", "", "path to nginx config file")
@@ -139,8 +138,60 @@ func main() {
 	flag.StringVar(&fastcgiFlag, "fastcgi-caches", "", "comma separated fastcgi cache names to purge")
 	flag.StringVar(&appName, "app-name", "", "app name used when rendering the nginx config (optional if cache paths are explicitly set)")
 	flag.StringVar(&purgeCommand, "purge-command", "", "command used to perform cache purging")
+	flag.StringVar(&purgeKey, "purge-key", "", "only remove the entry of this cache key")
+	flag.StringVar(&purgeURL, "purge-url", "", "only remove the entry of this url, see -cache-key-format")
+	flag.StringVar(&cacheKeyFormat, "cache-key-format", defaultCacheKeyFormat, "cache key of the location, used to derive the key of -purge-url")
+	flag.StringVar(&purgePrefix, "purge-prefix", "", "only remove the entries whose cache key starts with this prefix")
+	flag.StringVar(&purgeRegex, "purge-regex", "", "only remove the entries whose cache key matches this regular expression")
+	flag.StringVar(&purgeTagValue, "purge-tag", "", "only remove the entries tagged with this Cache-Tag or Surrogate-Key")
+	flag.BoolVar(&useTagIndex, "tag-index", false, "look -purge-tag up in a tag index kept next to the cache, instead of reading every cache file")
+	flag.BoolVar(&rebuildTagIndex, "rebuild-tag-index", false, "rebuild the tag index even if it is not stale")
+	flag.DurationVar(&tagIndexMaxAge, "tag-index-max-age", defaultTagIndexMaxAge, "age after which the tag index is rebuilt, instead of also reading the files modified since it was built")
+	flag.BoolVar(&dryRun, "dry-run", false, "list the entries matching -purge-prefix, -purge-regex or -purge-tag without removing them")
+	flag.IntVar(&workers, "workers", defaultPurgeWorkers, "number of cache files read concurrently")
+	flag.StringVar(&tombstonesOf, "delete-tombstones", "", "delete the tombstones of this cache directory left by purges, and exit")
+	flag.BoolVar(&gc, "gc", false, "report the cache directories no app references, and exit")
+	flag.StringVar(&gcAppsPath, "gc-apps", "-", "JSON lines describing every app for -gc, - reads them from stdin")
+	flag.BoolVar(&force, "force", false, "with -gc, delete the reported cache directories")
+	flag.StringVar(&onChangeProxy, "on-change-proxy-caches", "", "comma separated proxy cache names to purge if their fingerprint changed since their last purge")
+	flag.StringVar(&onChangeFastcgi, "on-change-fastcgi-caches", "", "comma separated fastcgi cache names to purge if their fingerprint changed since their last purge")
+	flag.StringVar(&manifestPath, "cache-manifest", "", "cache fingerprints of the current release, for -on-change-proxy-caches and -on-change-fastcgi-caches")
+	flag.StringVar(&purgedPath, "purged-cache-manifest", "", "cache fingerprints recorded at the last purges, updated after purging")
 	flag.Parse()
 
+	if tombstonesOf != "" {
+		if err := deleteTombstones(tombstonesOf); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if gc {
+		appsFile := os.Stdin
+		if gcAppsPath != "-" {
+			f, err := os.Open(gcAppsPath)
+			if err != nil {
+				log.Fatalln("failed to open -gc-apps:", err)
+			}
+			defer f.Close()
+			appsFile = f
+		}
+		apps, err := readGcApps(appsFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		result, err := gcCaches(apps, force, os.Stdout)
+		if force {
+			log.Printf("Deleted %d orphaned cache directories (%d bytes)\n", result.files, result.bytes)
+		} else if err == nil {
+			log.Printf("%d orphaned cache directories (%d bytes), rerun with -force to delete them\n", result.files, result.bytes)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	if configPath == "" {
 		log.Fatalln("missing required -config flag")
 	}
@@ -153,14 +204,69 @@ func main() {
 		}
 	}
 
-	proxyCaches := parseCSVFlag(proxyCachesFlag)
-	fastcgiCaches := parseCSVFlag(fastcgiFlag)
-
 	cfg, _, err := file_config.ReadConfig(configPath)
 	if err != nil {
 		log.Fatalln("error parsing config file:", err)
 	}
 
+	selectors := 0
+	for _, value := range []string{purgeKey, purgeURL, purgePrefix, purgeRegex, purgeTagValue} {
+		if value != "" {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		log.Fatalln("-purge-key, -purge-url, -purge-prefix, -purge-regex and -purge-tag are mutually exclusive")
+	}
+	if dryRun && purgePrefix == "" && purgeRegex == "" && purgeTagValue == "" {
+		log.Fatalln("-dry-run requires -purge-prefix, -purge-regex or -purge-tag")
+	}
+	if (useTagIndex || rebuildTagIndex) && purgeTagValue == "" {
+		log.Fatalln("-tag-index and -rebuild-tag-index require -purge-tag")
+	}
+	if (onChangeProxy != "" || onChangeFastcgi != "") && (selectors > 0 || manifestPath == "" || purgedPath == "") {
+		log.Fatalln("-on-change-proxy-caches and -on-change-fastcgi-caches require -cache-manifest and -purged-cache-manifest, and purge whole caches")
+	}
+	var match entryMatcher
+	switch {
+	case purgePrefix != "":
+		match = keyPrefixMatcher(purgePrefix)
+	case purgeRegex != "":
+		re, err := regexp.Compile(purgeRegex)
+		if err != nil {
+			log.Fatalln("invalid -purge-regex:", err)
+		}
+		match = keyRegexMatcher(re)
+	}
+	if purgeURL != "" {
+		key, err := cacheKeyFromURL(cacheKeyFormat, purgeURL)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		purgeKey = key
+	}
+
+	proxyCaches := parseCSVFlag(proxyCachesFlag)
+	fastcgiCaches := parseCSVFlag(fastcgiFlag)
+
+	var currentManifest nginx_cache.Manifest
+	if manifestPath != "" {
+		if currentManifest, err = nginx_cache.ReadManifest(manifestPath); err != nil {
+			log.Fatalln(err)
+		}
+		if currentManifest == nil {
+			log.Printf("[warn] %s not found, purging every on_change cache\n", manifestPath)
+		}
+	}
+	if onChangeProxy != "" || onChangeFastcgi != "" {
+		purged, err := nginx_cache.ReadManifest(purgedPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		proxyCaches = append(proxyCaches, changedCaches(currentManifest, purged, "proxy", parseCSVFlag(onChangeProxy))...)
+		fastcgiCaches = append(fastcgiCaches, changedCaches(currentManifest, purged, "fastcgi", parseCSVFlag(onChangeFastcgi))...)
+	}
+
 	selectedProxy, err := ensureCacheNameExists(cfg.ProxyCaches, proxyCaches, "proxy")
 	if err != nil {
 		log.Fatalln(err)
@@ -170,11 +276,68 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	proxyRoots := loadCacheRoots("proxy", len(selectedProxy) > 0)
-	fastcgiRoots := loadCacheRoots("fastcgi", len(selectedFastcgi) > 0)
+	proxyRoots := nginx_cache.LoadCacheRoots("proxy")
+	fastcgiRoots := nginx_cache.LoadCacheRoots("fastcgi")
+
+	if purgeKey != "" {
+		proxyDefaultFlags := nginx_cache.ParseCacheDefaultFlags(os.Getenv("PROXY_CACHE_DEFAULT_FLAGS"))
+		fastcgiDefaultFlags := nginx_cache.ParseCacheDefaultFlags(os.Getenv("FASTCGI_CACHE_DEFAULT_FLAGS"))
+		for name, cacheCfg := range selectedProxy {
+			if err := purgeCacheKey("proxy", appName, cacheCfg, proxyRoots, proxyDefaultFlags, purgeKey); err != nil {
+				log.Fatalf("proxy cache %q: %v\n", name, err)
+			}
+		}
+		for name, cacheCfg := range selectedFastcgi {
+			if err := purgeCacheKey("fastcgi", appName, cacheCfg, fastcgiRoots, fastcgiDefaultFlags, purgeKey); err != nil {
+				log.Fatalf("fastcgi cache %q: %v\n", name, err)
+			}
+		}
+		return
+	}
+
+	if match != nil || purgeTagValue != "" {
+		var total purgeResult
+		purge := func(kind string, name string, cacheCfg file_config.CacheConfig, roots map[string]string) {
+			cachePath, err := nginx_cache.BuildCachePath(kind, appName, cacheCfg, roots)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Printf("Purging matching entries of %s cache %q at %s\n", kind, name, cachePath)
+			var result purgeResult
+			if purgeTagValue != "" {
+				result, err = purgeTag(cachePath, purgeTagValue, purgeTagOptions{
+					workers:      workers,
+					dryRun:       dryRun,
+					out:          os.Stdout,
+					useIndex:     useTagIndex || rebuildTagIndex,
+					rebuildIndex: rebuildTagIndex,
+					indexMaxAge:  tagIndexMaxAge,
+					now:          time.Now(),
+				})
+			} else {
+				result, err = purgeMatching(cachePath, match, workers, dryRun, os.Stdout)
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+			total.add(result)
+		}
+		for name, cacheCfg := range selectedProxy {
+			purge("proxy", name, cacheCfg, proxyRoots)
+		}
+		for name, cacheCfg := range selectedFastcgi {
+			purge("fastcgi", name, cacheCfg, fastcgiRoots)
+		}
+		if dryRun {
+			log.Printf("%d files (%d bytes) would be freed\n", total.files, total.bytes)
+		} else {
+			log.Printf("Freed %d files (%d bytes)\n", total.files, total.bytes)
+		}
+		return
+	}
 
 	for name, cacheCfg := range selectedProxy {
-		cachePath, err := buildCachePath("proxy", appName, cacheCfg, proxyRoots)
+		cachePath, err := nginx_cache.BuildCachePath("proxy", appName, cacheCfg, proxyRoots)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -185,7 +348,7 @@ func main() {
 	}
 
 	for name, cacheCfg := range selectedFastcgi {
-		cachePath, err := buildCachePath("fastcgi", appName, cacheCfg, fastcgiRoots)
+		cachePath, err := nginx_cache.BuildCachePath("fastcgi", appName, cacheCfg, fastcgiRoots)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -194,4 +357,10 @@ func main() {
 			log.Fatalln(err)
 		}
 	}
+
+	if purgedPath != "" && currentManifest != nil {
+		if err := recordPurges(purgedPath, currentManifest, map[string][]string{"proxy": proxyCaches, "fastcgi": fastcgiCaches}); err != nil {
+			log.Fatalln("failed to record purged cache fingerprints:", err)
+		}
+	}
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"log"
+	"slices"
+)
+
+// changedCaches returns the `purge_on_deploy: on_change` caches whose
+// fingerprint in the current release differs from the one recorded at their
+// last purge. It is decided at purge time, as a deploy builds the config more
+// than once.
+func changedCaches(current nginx_cache.Manifest, purged nginx_cache.Manifest, kind string, names []string) []string {
+	changed := nginx_cache.ChangedCaches(current, purged, kind, names)
+	for _, name := range names {
+		if !slices.Contains(changed, name) {
+			log.Printf("Keeping %s cache %q, its key and flags did not change\n", kind, name)
+		}
+	}
+	return changed
+}
+
+// recordPurges records the fingerprints the purged caches, by kind, were
+// purged at.
+func recordPurges(purgedPath string, current nginx_cache.Manifest, purgedCaches map[string][]string) error {
+	purged, err := nginx_cache.ReadManifest(purgedPath)
+	if err != nil {
+		return err
+	}
+	if purged == nil {
+		purged = make(nginx_cache.Manifest)
+	}
+	for kind, names := range purgedCaches {
+		for _, name := range names {
+			purged.RecordPurge(current, kind, name)
+		}
+	}
+	return nginx_cache.WriteManifest(purgedPath, purged)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangedCachesAndRecordPurges(t *testing.T) {
+	purgedPath := filepath.Join(t.TempDir(), nginx_cache.PurgedManifestFile)
+	current := nginx_cache.Manifest{"proxy": {"pages": "a", "assets": "b"}}
+
+	purged, err := nginx_cache.ReadManifest(purgedPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	changed := changedCaches(current, purged, "proxy", []string{"pages", "assets"})
+	if !reflect.DeepEqual(changed, []string{"pages", "assets"}) {
+		t.Errorf("expected caches never purged to change, got %v", changed)
+	}
+	if err := recordPurges(purgedPath, current, map[string][]string{"proxy": changed}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	current = nginx_cache.Manifest{"proxy": {"pages": "c", "assets": "b"}}
+	purged, err = nginx_cache.ReadManifest(purgedPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	changed = changedCaches(current, purged, "proxy", []string{"pages", "assets"})
+	if !reflect.DeepEqual(changed, []string{"pages"}) {
+		t.Errorf("expected only pages to change, got %v", changed)
+	}
+
+	// a cache missing from the release manifest is purged, and purged again
+	// until its fingerprint is known
+	changed = changedCaches(nginx_cache.Manifest{}, purged, "proxy", []string{"assets"})
+	if !reflect.DeepEqual(changed, []string{"assets"}) {
+		t.Errorf("expected an unknown fingerprint to change, got %v", changed)
+	}
+	if err := recordPurges(purgedPath, nginx_cache.Manifest{}, map[string][]string{"proxy": changed}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	purged, err = nginx_cache.ReadManifest(purgedPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := purged["proxy"]["assets"]; ok {
+		t.Errorf("expected the unknown fingerprint not to be recorded, got %v", purged)
+	}
+}
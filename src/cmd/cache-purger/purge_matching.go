@@ -0,0 +1,151 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const defaultPurgeWorkers = 8
+
+// entryMatcher selects the cache entries to purge.
+type entryMatcher func(entry *nginx_cache.Entry) bool
+
+func keyPrefixMatcher(prefix string) entryMatcher {
+	return func(entry *nginx_cache.Entry) bool {
+		return strings.HasPrefix(entry.Key, prefix)
+	}
+}
+
+func keyRegexMatcher(re *regexp.Regexp) entryMatcher {
+	return func(entry *nginx_cache.Entry) bool {
+		return re.MatchString(entry.Key)
+	}
+}
+
+type purgeResult struct {
+	files int64
+	bytes int64
+}
+
+func (r *purgeResult) add(other purgeResult) {
+	r.files += other.files
+	r.bytes += other.bytes
+}
+
+// readEntries reads the cache files sent by produce with a bounded pool of
+// workers, and calls fn concurrently for each of them.
+func readEntries(workers int, produce func(paths chan<- string) error, fn func(path string, entry *nginx_cache.Entry)) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	paths := make(chan string, workers*4)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				entry, err := nginx_cache.ReadEntry(path)
+				if errors.Is(err, fs.ErrNotExist) {
+					// evicted by the cache manager meanwhile
+					continue
+				}
+				if err != nil {
+					log.Printf("[warn] skipping %s: %v\n", path, err)
+					continue
+				}
+				fn(path, entry)
+			}
+		}()
+	}
+
+	err := produce(paths)
+	close(paths)
+	wg.Wait()
+	return err
+}
+
+// walkEntryPaths sends the path of every entry of the cache at cachePath.
+func walkEntryPaths(cachePath string) func(paths chan<- string) error {
+	return walkFilteredEntryPaths(cachePath, func(string, fs.DirEntry) bool { return true })
+}
+
+// walkFilteredEntryPaths sends the path of the entries of the cache at
+// cachePath for which keep returns true.
+func walkFilteredEntryPaths(cachePath string, keep func(path string, d fs.DirEntry) bool) func(paths chan<- string) error {
+	return func(paths chan<- string) error {
+		err := filepath.WalkDir(cachePath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					// nothing cached yet, or evicted by the cache manager meanwhile
+					return nil
+				}
+				return err
+			}
+			if !d.IsDir() && nginx_cache.IsEntryName(d.Name()) && keep(path, d) {
+				paths <- path
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to walk cache %s: %w", cachePath, err)
+		}
+		return nil
+	}
+}
+
+// entryPurger removes the entries matching match. With dryRun, matches are
+// only listed on out.
+type entryPurger struct {
+	match  entryMatcher
+	dryRun bool
+	out    io.Writer
+
+	mu     sync.Mutex
+	result purgeResult
+}
+
+// purge removes entry if it matches, and tells whether it matched.
+func (p *entryPurger) purge(path string, entry *nginx_cache.Entry) bool {
+	if !p.match(entry) {
+		return false
+	}
+	if !p.dryRun {
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("[warn] failed to remove %s: %v\n", path, err)
+				return false
+			}
+			return true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.result.add(purgeResult{files: 1, bytes: entry.Size})
+	if p.dryRun {
+		fmt.Fprintf(p.out, "%s\t%s\t%d\n", entry.Key, path, entry.Size)
+	}
+	return true
+}
+
+// purgeMatching reads the entries of the cache at cachePath with a bounded
+// pool of workers and removes those matching match. With dryRun, matches are
+// only listed on out.
+func purgeMatching(cachePath string, match entryMatcher, workers int, dryRun bool, out io.Writer) (purgeResult, error) {
+	purger := &entryPurger{match: match, dryRun: dryRun, out: out}
+	err := readEntries(workers, walkEntryPaths(cachePath), func(path string, entry *nginx_cache.Entry) {
+		purger.purge(path, entry)
+	})
+	return purger.result, err
+}
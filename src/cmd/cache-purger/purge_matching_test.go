@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+)
+
+// writeTestCacheEntry writes the entry of key as nginx stores it with
+// levels=1:2, and returns its path.
+func writeTestCacheEntry(t *testing.T, cachePath string, key string, headers string, body string) string {
+	t.Helper()
+	head := make([]byte, nginx_cache.HeaderSize)
+	keyLine := "\nKEY: " + key + "\n"
+	headerStart := nginx_cache.HeaderSize + len(keyLine)
+	binary.LittleEndian.PutUint64(head[0:8], nginx_cache.Version)
+	binary.LittleEndian.PutUint16(head[54:56], uint16(headerStart))
+	binary.LittleEndian.PutUint16(head[56:58], uint16(headerStart+len(headers)))
+
+	entryPath := cacheEntryPath(cachePath, []int{1, 2}, key)
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := append(append(append(head, keyLine...), headers...), body...)
+	if err := os.WriteFile(entryPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return entryPath
+}
+
+func TestPurgeMatching(t *testing.T) {
+	cachePath := t.TempDir()
+	headers := "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n"
+	blogPost := writeTestCacheEntry(t, cachePath, "httpsexample.com/blog/post", headers, "post")
+	blogIndex := writeTestCacheEntry(t, cachePath, "httpsexample.com/blog/", headers, "index")
+	home := writeTestCacheEntry(t, cachePath, "httpsexample.com/", headers, "home")
+
+	out := &bytes.Buffer{}
+	result, err := purgeMatching(cachePath, keyPrefixMatcher("httpsexample.com/blog/"), 2, true, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.files != 2 {
+		t.Fatalf("expected 2 matches, got %d", result.files)
+	}
+	if !strings.Contains(out.String(), blogPost) || !strings.Contains(out.String(), blogIndex) {
+		t.Fatalf("expected dry run to list the matches, got: %s", out.String())
+	}
+	for _, path := range []string{blogPost, blogIndex, home} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected dry run to keep %s", path)
+		}
+	}
+
+	info, err := os.Stat(blogPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = purgeMatching(cachePath, keyRegexMatcher(regexp.MustCompile(`/blog/.+`)), 2, false, out)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.files != 1 || result.bytes != info.Size() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if _, err := os.Stat(blogPost); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed", blogPost)
+	}
+	for _, path := range []string{blogIndex, home} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept", path)
+		}
+	}
+
+	result, err = purgeMatching(filepath.Join(cachePath, "missing"), keyPrefixMatcher(""), 2, false, out)
+	if err != nil || result.files != 0 {
+		t.Fatalf("expected a missing cache to be empty, got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTagIndexMaxAge = time.Hour
+
+const tagIndexMetaFile = "index.json"
+
+// entryTags returns the tags of a cached response, from its Cache-Tag
+// (comma separated) and Surrogate-Key (space separated) headers.
+func entryTags(entry *nginx_cache.Entry) []string {
+	tags := make([]string, 0)
+	for _, value := range entry.Headers.Values("Cache-Tag") {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, value := range entry.Headers.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(value)...)
+	}
+	return tags
+}
+
+func tagMatcher(tag string) entryMatcher {
+	return func(entry *nginx_cache.Entry) bool {
+		for _, entryTag := range entryTags(entry) {
+			if entryTag == tag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// tagIndexPath returns the tag index of a cache. It is kept next to the cache
+// directory, as nginx removes unknown files from it.
+func tagIndexPath(cachePath string) string {
+	return filepath.Clean(cachePath) + ".tag-index"
+}
+
+type tagIndexMeta struct {
+	BuiltAt time.Time `json:"built_at"`
+}
+
+// tagIndex maps tags to the cache files holding them, relative to the cache
+// directory. It holds one file per tag, named after the MD5 of the tag. It
+// knows nothing about entries cached after it was built, which are found by
+// their modification time, and it is rebuilt once older than its max age.
+type tagIndex struct {
+	dir string
+}
+
+func tagIndexFileName(tag string) string {
+	sum := md5.Sum([]byte(tag))
+	return hex.EncodeToString(sum[:])
+}
+
+// builtAt returns when the index was built, or the zero time if there is none.
+func (idx tagIndex) builtAt() (time.Time, error) {
+	content, err := os.ReadFile(filepath.Join(idx.dir, tagIndexMetaFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read tag index: %w", err)
+	}
+	meta := tagIndexMeta{}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		// a corrupted index is rebuilt
+		return time.Time{}, nil
+	}
+	return meta.BuiltAt, nil
+}
+
+func (idx tagIndex) paths(tag string) ([]string, error) {
+	f, err := os.Open(filepath.Join(idx.dir, tagIndexFileName(tag)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tag index: %w", err)
+	}
+	defer f.Close()
+
+	paths := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+func writeTagIndexFile(path string, paths []string) error {
+	if len(paths) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(path, []byte(strings.Join(paths, "\n")+"\n"), 0o600)
+}
+
+// write replaces the index with tags, built at builtAt.
+func (idx tagIndex) write(tags map[string][]string, builtAt time.Time) error {
+	tmpDir := idx.dir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return err
+	}
+	for tag, paths := range tags {
+		if err := writeTagIndexFile(filepath.Join(tmpDir, tagIndexFileName(tag)), paths); err != nil {
+			return err
+		}
+	}
+	meta, err := json.Marshal(tagIndexMeta{BuiltAt: builtAt})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, tagIndexMetaFile), meta, 0o600); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(idx.dir); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, idx.dir)
+}
+
+type purgeTagOptions struct {
+	workers      int
+	dryRun       bool
+	out          io.Writer
+	useIndex     bool
+	rebuildIndex bool
+	indexMaxAge  time.Duration
+	now          time.Time
+}
+
+// purgeTag removes the entries of the cache at cachePath tagged with tag.
+// Without index, every cache file is read. With it, only the files indexed
+// for tag and the ones modified since the index was built are, unless the
+// index is missing or stale, in which case it is rebuilt while purging.
+func purgeTag(cachePath string, tag string, opts purgeTagOptions) (purgeResult, error) {
+	purger := &entryPurger{match: tagMatcher(tag), dryRun: opts.dryRun, out: opts.out}
+	if !opts.useIndex {
+		err := readEntries(opts.workers, walkEntryPaths(cachePath), func(path string, entry *nginx_cache.Entry) {
+			purger.purge(path, entry)
+		})
+		return purger.result, err
+	}
+
+	idx := tagIndex{dir: tagIndexPath(cachePath)}
+	builtAt, err := idx.builtAt()
+	if err != nil {
+		return purgeResult{}, err
+	}
+	if opts.rebuildIndex || builtAt.IsZero() || opts.now.Sub(builtAt) > opts.indexMaxAge {
+		log.Printf("Rebuilding tag index %s\n", idx.dir)
+		return purgeTagRebuildingIndex(cachePath, idx, purger, opts)
+	}
+
+	indexed, err := idx.paths(tag)
+	if err != nil {
+		return purgeResult{}, err
+	}
+	indexedPaths := make(map[string]bool, len(indexed))
+	for _, rel := range indexed {
+		indexedPaths[filepath.Join(cachePath, rel)] = true
+	}
+	var (
+		mu   sync.Mutex
+		kept []string
+	)
+	err = readEntries(opts.workers, func(paths chan<- string) error {
+		for path := range indexedPaths {
+			paths <- path
+		}
+		// entries cached since the index was built are not in it
+		return walkFilteredEntryPaths(cachePath, func(path string, d fs.DirEntry) bool {
+			if indexedPaths[path] {
+				return false
+			}
+			info, err := d.Info()
+			return err == nil && info.ModTime().After(builtAt)
+		})(paths)
+	}, func(path string, entry *nginx_cache.Entry) {
+		// the file may hold another response since the index was built
+		if purger.purge(path, entry) && !opts.dryRun {
+			return
+		}
+		if !indexedPaths[path] {
+			// left for the next rebuild to index
+			return
+		}
+		if rel, err := filepath.Rel(cachePath, path); err == nil {
+			mu.Lock()
+			kept = append(kept, rel)
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		return purger.result, err
+	}
+	if !opts.dryRun {
+		if err := writeTagIndexFile(filepath.Join(idx.dir, tagIndexFileName(tag)), kept); err != nil {
+			return purger.result, fmt.Errorf("failed to update tag index: %w", err)
+		}
+	}
+	return purger.result, nil
+}
+
+// purgeTagRebuildingIndex reads every cache file once, purging the tagged ones
+// and indexing the tags of the others.
+func purgeTagRebuildingIndex(cachePath string, idx tagIndex, purger *entryPurger, opts purgeTagOptions) (purgeResult, error) {
+	var mu sync.Mutex
+	tags := make(map[string][]string)
+	err := readEntries(opts.workers, walkEntryPaths(cachePath), func(path string, entry *nginx_cache.Entry) {
+		if purger.purge(path, entry) && !opts.dryRun {
+			return
+		}
+		rel, err := filepath.Rel(cachePath, path)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, tag := range entryTags(entry) {
+			tags[tag] = append(tags[tag], rel)
+		}
+	})
+	if err != nil {
+		return purger.result, err
+	}
+	if err := idx.write(tags, opts.now); err != nil {
+		return purger.result, fmt.Errorf("failed to write tag index: %w", err)
+	}
+	return purger.result, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPurgeTag(t *testing.T) {
+	cachePath := t.TempDir()
+	tagged := writeTestCacheEntry(t, cachePath, "httpsexample.com/a", "HTTP/1.1 200 OK\r\nCache-Tag: product-1, list\r\n\r\n", "a")
+	surrogate := writeTestCacheEntry(t, cachePath, "httpsexample.com/b", "HTTP/1.1 200 OK\r\nSurrogate-Key: list product-2\r\n\r\n", "b")
+	other := writeTestCacheEntry(t, cachePath, "httpsexample.com/c", "HTTP/1.1 200 OK\r\nCache-Tag: product-10\r\n\r\n", "c")
+
+	result, err := purgeTag(cachePath, "product-1", purgeTagOptions{workers: 2, out: io.Discard})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.files != 1 {
+		t.Fatalf("expected 1 removed file, got %d", result.files)
+	}
+	if _, err := os.Stat(tagged); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed", tagged)
+	}
+	for _, path := range []string{surrogate, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept", path)
+		}
+	}
+}
+
+func TestPurgeTagWithIndex(t *testing.T) {
+	cachePath := t.TempDir()
+	now := time.Unix(1700000000, 0)
+	opts := purgeTagOptions{workers: 2, out: io.Discard, useIndex: true, indexMaxAge: time.Hour, now: now}
+	first := writeTestCacheEntry(t, cachePath, "httpsexample.com/a", "HTTP/1.1 200 OK\r\nCache-Tag: list\r\n\r\n", "a")
+	second := writeTestCacheEntry(t, cachePath, "httpsexample.com/b", "HTTP/1.1 200 OK\r\nSurrogate-Key: list\r\n\r\n", "b")
+	other := writeTestCacheEntry(t, cachePath, "httpsexample.com/d", "HTTP/1.1 200 OK\r\nCache-Tag: other\r\n\r\n", "d")
+	for _, path := range []string{first, second, other} {
+		if err := os.Chtimes(path, now.Add(-time.Minute), now.Add(-time.Minute)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// no index yet: it is built while purging
+	result, err := purgeTag(cachePath, "missing", opts)
+	if err != nil || result.files != 0 {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	idx := tagIndex{dir: tagIndexPath(cachePath)}
+	if builtAt, _ := idx.builtAt(); !builtAt.Equal(now) {
+		t.Fatalf("expected the index to be built at %s, got %s", now, builtAt)
+	}
+	if paths, _ := idx.paths("list"); len(paths) != 2 {
+		t.Fatalf("expected 2 indexed paths, got %v", paths)
+	}
+
+	// cached after the index was built
+	third := writeTestCacheEntry(t, cachePath, "httpsexample.com/c", "HTTP/1.1 200 OK\r\nCache-Tag: list\r\n\r\n", "c")
+	if err := os.Chtimes(third, now.Add(time.Minute), now.Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts.now = now.Add(2 * time.Minute)
+	result, err = purgeTag(cachePath, "list", opts)
+	if err != nil || result.files != 3 {
+		t.Fatalf("expected the 2 indexed files and the one cached since to be removed, got %+v, %v", result, err)
+	}
+	for _, path := range []string{first, second, third} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", path)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("expected %s, tagged otherwise, to be kept", other)
+	}
+	if paths, _ := idx.paths("list"); len(paths) != 0 {
+		t.Fatalf("expected removed paths to leave the index, got %v", paths)
+	}
+
+	// cached after the index was built, and purged once it is stale
+	fourth := writeTestCacheEntry(t, cachePath, "httpsexample.com/e", "HTTP/1.1 200 OK\r\nCache-Tag: list\r\n\r\n", "e")
+	opts.now = now.Add(2 * time.Hour)
+	result, err = purgeTag(cachePath, "list", opts)
+	if err != nil || result.files != 1 {
+		t.Fatalf("expected the stale index to be rebuilt, got %+v, %v", result, err)
+	}
+	if _, err := os.Stat(fourth); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed", fourth)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const tombstoneSuffix = ".tombstone-"
+
+func tombstonePath(cachePath string, now time.Time) string {
+	return fmt.Sprintf("%s%s%d", filepath.Clean(cachePath), tombstoneSuffix, now.UnixNano())
+}
+
+// cacheTombstones returns the tombstones of a cache, including those left by
+// runs that crashed before deleting them.
+func cacheTombstones(cachePath string) ([]string, error) {
+	return filepath.Glob(filepath.Clean(cachePath) + tombstoneSuffix + "*")
+}
+
+// tombstoneCacheDir empties a live cache directory without blocking on its
+// size: it is renamed to a tombstone, which is atomic, and an empty directory
+// with the same mode and ownership is created in its place. The tombstone is
+// left to deleteTombstones. It returns false if the cache does not exist.
+func tombstoneCacheDir(cachePath string, now time.Time) (bool, error) {
+	info, err := os.Stat(cachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat cache dir %s: %w", cachePath, err)
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("cache path %s is not a directory", cachePath)
+	}
+
+	tombstone := tombstonePath(cachePath, now)
+	if err := os.Rename(cachePath, tombstone); err != nil {
+		return false, fmt.Errorf("failed to move cache dir %s to %s: %w", cachePath, tombstone, err)
+	}
+	if err := os.Mkdir(cachePath, info.Mode().Perm()); err != nil {
+		return true, fmt.Errorf("failed to recreate cache dir %s: %w", cachePath, err)
+	}
+	// Mkdir applies the umask
+	if err := os.Chmod(cachePath, info.Mode().Perm()); err != nil {
+		return true, fmt.Errorf("failed to set mode of cache dir %s: %w", cachePath, err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Chown(cachePath, int(stat.Uid), int(stat.Gid)); err != nil {
+			return true, fmt.Errorf("failed to set owner of cache dir %s: %w", cachePath, err)
+		}
+	}
+	return true, nil
+}
+
+// deleteTombstones deletes every tombstone of a cache.
+func deleteTombstones(cachePath string) error {
+	tombstones, err := cacheTombstones(cachePath)
+	if err != nil {
+		return err
+	}
+	for _, tombstone := range tombstones {
+		log.Printf("Deleting cache tombstone %s\n", tombstone)
+		if err := os.RemoveAll(tombstone); err != nil {
+			return fmt.Errorf("failed to delete cache tombstone %s: %w", tombstone, err)
+		}
+	}
+	return nil
+}
+
+// spawnTombstoneDeleter runs `cache-purger -delete-tombstones` in a detached
+// process, with idle I/O priority when ionice is available, so deleting a
+// large cache neither blocks nor slows down the caller.
+func spawnTombstoneDeleter(cachePath string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate cache-purger: %w", err)
+	}
+	args := []string{self, "-delete-tombstones", cachePath}
+	if ionice, err := exec.LookPath("ionice"); err == nil {
+		args = append([]string{ionice, "-c", "3"}, args...)
+	}
+	if nice, err := exec.LookPath("nice"); err == nil {
+		args = append([]string{nice, "-n", "19"}, args...)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	log.Printf("Deleting cache tombstones in the background: %s\n", cmd.String())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start tombstone deletion: %w", err)
+	}
+	return cmd.Process.Release()
+}
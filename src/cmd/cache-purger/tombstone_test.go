@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTombstoneCacheDir(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "proxy_myapp_pages")
+	if err := os.Mkdir(cachePath, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	entryPath := writeTestCacheEntry(t, cachePath, "httpsexample.com/", "HTTP/1.1 200 OK\r\n\r\n", "home")
+
+	// left by a crashed run
+	leftover := tombstonePath(cachePath, time.Unix(1600000000, 0))
+	if err := os.MkdirAll(filepath.Join(leftover, "a", "bc"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	moved, err := tombstoneCacheDir(cachePath, now)
+	if err != nil || !moved {
+		t.Fatalf("unexpected result %v, %v", moved, err)
+	}
+
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatalf("expected the cache dir to be recreated: %v", err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Fatalf("expected mode 0700, got %s", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(cachePath)
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty cache dir, got %v", entries)
+	}
+	rel, _ := filepath.Rel(cachePath, entryPath)
+	if _, err := os.Stat(filepath.Join(tombstonePath(cachePath, now), rel)); err != nil {
+		t.Fatalf("expected the entry to be moved to the tombstone: %v", err)
+	}
+
+	tombstones, err := cacheTombstones(cachePath)
+	if err != nil || len(tombstones) != 2 {
+		t.Fatalf("expected 2 tombstones, got %v, %v", tombstones, err)
+	}
+	if err := deleteTombstones(cachePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tombstones, _ := cacheTombstones(cachePath); len(tombstones) != 0 {
+		t.Fatalf("expected tombstones to be deleted, got %v", tombstones)
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Fatalf("expected the cache dir to be kept: %v", err)
+	}
+
+	moved, err = tombstoneCacheDir(filepath.Join(t.TempDir(), "missing"), now)
+	if err != nil || moved {
+		t.Fatalf("expected a missing cache dir to be skipped, got %v, %v", moved, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+)
+
+// splitAccessEntries splits a whitespace/comma/newline separated list of
+// addresses, ignoring `#` comments.
+func splitAccessEntries(raw string) []string {
+	entries := make([]string, 0)
+	for _, line := range strings.Split(raw, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		entries = append(entries, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})...)
+	}
+	return entries
+}
+
+// validateAccessAddress accepts an IP or a CIDR. Host bits set in a CIDR are
+// only reported, as nginx does.
+func validateAccessAddress(entry string) error {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", entry)
+		}
+		if prefix.Masked() != prefix {
+			log.Printf("[warn] access entry %q has host bits set, nginx will use %s\n", entry, prefix.Masked())
+		}
+		return nil
+	}
+	if _, err := netip.ParseAddr(entry); err != nil {
+		return fmt.Errorf("invalid IP address %q", entry)
+	}
+	return nil
+}
+
+// resolveAccessEntries expands list: and file: references into addresses.
+func resolveAccessEntries(appName string, entries []string, config *file_config.Config, data *locationConfigData) ([]string, error) {
+	resolved := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var expanded []string
+		switch {
+		case strings.HasPrefix(entry, "list:"):
+			name := strings.TrimPrefix(entry, "list:")
+			found := false
+			for _, list := range config.AccessLists {
+				if list.Name == name {
+					expanded = list.Entries
+					found = true
+					break
+				}
+			}
+			if !found && data.getProperty != nil {
+				if value := data.getProperty(appName, fmt.Sprintf("access-list-%s", name)); value != "" {
+					expanded = splitAccessEntries(value)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("access list %q not found in access_lists or access-list-%s property", name, name)
+			}
+		case strings.HasPrefix(entry, "file:"):
+			if data.readImageFile == nil {
+				return nil, fmt.Errorf("cannot read access entries from %q: image files are not available", entry)
+			}
+			content, err := data.readImageFile(strings.TrimPrefix(entry, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			expanded = splitAccessEntries(string(content))
+		default:
+			expanded = []string{entry}
+		}
+
+		for _, address := range expanded {
+			if err := validateAccessAddress(address); err != nil {
+				return nil, fmt.Errorf("access entry %q: %w", entry, err)
+			}
+			resolved = append(resolved, address)
+		}
+	}
+	return resolved, nil
+}
+
+// buildAccessLines renders allow/deny directives in the order of the rules, as
+// nginx applies the first one matching, and the default policy closes the list.
+func buildAccessLines(appName string, access *file_config.AccessConfig, config *file_config.Config, data *locationConfigData) ([]string, error) {
+	lines := make([]string, 0, len(access.Rules)+1)
+	allows := false
+	for _, rule := range access.Rules {
+		directive, entry := "deny", rule.Deny
+		if rule.Allow != "" {
+			directive, entry = "allow", rule.Allow
+			allows = true
+		}
+		addresses, err := resolveAccessEntries(appName, []string{entry}, config, data)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			lines = append(lines, fmt.Sprintf("%s %s;", directive, address))
+		}
+	}
+
+	defaultPolicy := access.Default
+	if defaultPolicy == "" {
+		defaultPolicy = "allow"
+		if allows {
+			defaultPolicy = "deny"
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%s all;", defaultPolicy))
+	return lines, nil
+}
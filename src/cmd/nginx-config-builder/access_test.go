@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildAccessLines(t *testing.T) {
+	cfg := &file_config.Config{
+		AccessLists: []file_config.AccessListConfig{
+			{Name: "office", Entries: []string{"203.0.113.0/24"}},
+		},
+	}
+	data := &locationConfigData{
+		getProperty: func(appName string, property string) string {
+			if property == "access-list-vpn" {
+				return "10.8.0.0/16, 10.9.0.0/16\n# legacy\n"
+			}
+			return ""
+		},
+		readImageFile: func(filePath string) ([]byte, error) {
+			if filePath != ".dokku/partners.txt" {
+				return nil, fmt.Errorf("unexpected file %q", filePath)
+			}
+			return []byte("198.51.100.7\n2001:db8::/32 # partner v6\n"), nil
+		},
+	}
+
+	build := func(t *testing.T, access *file_config.AccessConfig) []string {
+		t.Helper()
+		lines, err := buildAccessLines("myapp", access, cfg, data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return lines
+	}
+
+	t.Run("Entries", func(t *testing.T) {
+		lines := build(t, &file_config.AccessConfig{Rules: []file_config.AccessRuleConfig{
+			{Allow: "list:office"},
+			{Allow: "list:vpn"},
+			{Allow: "file:.dokku/partners.txt"},
+		}})
+		expected := []string{
+			"allow 203.0.113.0/24;",
+			"allow 10.8.0.0/16;",
+			"allow 10.9.0.0/16;",
+			"allow 198.51.100.7;",
+			"allow 2001:db8::/32;",
+			"deny all;",
+		}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("unexpected access lines:\n%s", strings.Join(lines, "\n"))
+		}
+	})
+
+	t.Run("RuleOrder", func(t *testing.T) {
+		lines := build(t, &file_config.AccessConfig{Rules: []file_config.AccessRuleConfig{
+			{Allow: "203.0.113.66"},
+			{Deny: "list:office"},
+			{Allow: "10.0.0.0/8"},
+		}})
+		expected := []string{"allow 203.0.113.66;", "deny 203.0.113.0/24;", "allow 10.0.0.0/8;", "deny all;"}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("expected the rules in order, got:\n%s", strings.Join(lines, "\n"))
+		}
+	})
+
+	t.Run("DefaultAllowWithOnlyDenies", func(t *testing.T) {
+		lines := build(t, &file_config.AccessConfig{Rules: []file_config.AccessRuleConfig{{Deny: "203.0.113.66"}}})
+		if lines[len(lines)-1] != "allow all;" {
+			t.Errorf("expected allow all last, got: %v", lines)
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		lines := build(t, &file_config.AccessConfig{Rules: []file_config.AccessRuleConfig{{Allow: "10.0.0.0/8"}}, Default: "allow"})
+		if lines[len(lines)-1] != "allow all;" {
+			t.Errorf("expected the configured default last, got: %v", lines)
+		}
+	})
+
+	for name, rule := range map[string]file_config.AccessRuleConfig{
+		"InvalidCidr": {Allow: "10.0.0.0/33"},
+		"InvalidIp":   {Deny: "not-an-ip"},
+		"MissingList": {Allow: "list:missing"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := buildAccessLines("myapp", &file_config.AccessConfig{Rules: []file_config.AccessRuleConfig{rule}}, cfg, data); err == nil {
+				t.Errorf("expected error for %+v", rule)
+			}
+		})
+	}
+}
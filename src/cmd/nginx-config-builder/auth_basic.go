@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gliderlabs/sigil"
+)
+
+// releaseFiles holds additional files (relative to the release directory) that
+// must be written next to the generated nginx config.
+type releaseFiles map[string]string
+
+// htpasswdHashedPrefixes are the password schemes nginx understands natively
+// (plus the crypt(3) ones). Entries already using them are not hashed again.
+var htpasswdHashedPrefixes = []string{"{SHA}", "{SSHA}", "{PLAIN}", "$apr1$", "$1$", "$2a$", "$2b$", "$2y$", "$5$", "$6$"}
+
+func hashHtpasswdPassword(password string) (string, error) {
+	for _, prefix := range htpasswdHashedPrefixes {
+		if strings.HasPrefix(password, prefix) {
+			return password, nil
+		}
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	sum := sha1.Sum(append([]byte(password), salt...))
+	return "{SSHA}" + base64.StdEncoding.EncodeToString(append(sum[:], salt...)), nil
+}
+
+// buildHtpasswd converts `user:password` entries, one per line, into htpasswd
+// file content. Entries are not split on commas, as passwords may contain them.
+func buildHtpasswd(users string) (string, error) {
+	out := ""
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(users, "\n") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || password == "" {
+			return "", fmt.Errorf("invalid auth_basic user entry %q; expected user:password", user)
+		}
+		if seen[user] {
+			return "", fmt.Errorf("duplicate auth_basic user %q", user)
+		}
+		seen[user] = true
+
+		hashed, err := hashHtpasswdPassword(password)
+		if err != nil {
+			return "", err
+		}
+		out += fmt.Sprintf("%s:%s\n", user, hashed)
+	}
+	if out == "" {
+		return "", fmt.Errorf("no auth_basic users defined")
+	}
+	return out, nil
+}
+
+func readAuthBasicUsers(appName string, authBasic *file_config.AuthBasicConfig, data *locationConfigData, tmplData map[string]any) (string, error) {
+	if authBasic.UsersProperty != "" {
+		if data.getProperty == nil {
+			return "", fmt.Errorf("cannot read users_property %q: dokku properties are not available", authBasic.UsersProperty)
+		}
+		users := data.getProperty(appName, authBasic.UsersProperty)
+		if users == "" {
+			return "", fmt.Errorf("dokku property %q is empty", authBasic.UsersProperty)
+		}
+		return users, nil
+	}
+
+	usersFileOut, err := sigil.Execute([]byte(authBasic.UsersFile), tmplData, "auth_basic_users_file")
+	if err != nil {
+		return "", fmt.Errorf("failed to parse auth_basic.users_file template: %w", err)
+	}
+	users, err := os.ReadFile(usersFileOut.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to read auth_basic users file: %w", err)
+	}
+	return string(users), nil
+}
+
+// buildAuthBasicLines renders the auth_basic directives for a vhost or location
+// and registers the generated htpasswd file under filename in files.
+func buildAuthBasicLines(appName string, authBasic *file_config.AuthBasicConfig, filename string, data *locationConfigData, tmplData map[string]any, files releaseFiles) ([]string, error) {
+	users, err := readAuthBasicUsers(appName, authBasic, data, tmplData)
+	if err != nil {
+		return nil, err
+	}
+	htpasswd, err := buildHtpasswd(users)
+	if err != nil {
+		return nil, err
+	}
+	files[filename] = htpasswd
+
+	realm := authBasic.Realm
+	if realm == "" {
+		realm = "Restricted"
+	}
+
+	return []string{
+		fmt.Sprintf("auth_basic %s;", nginxQuote(realm)),
+		fmt.Sprintf("auth_basic_user_file %s;", path.Join(data.releaseDir, filename)),
+	}, nil
+}
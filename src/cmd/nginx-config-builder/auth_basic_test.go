@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildHtpasswd(t *testing.T) {
+	out, err := buildHtpasswd("alice:secret\r\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n# comment\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 htpasswd lines, got: %q", out)
+	}
+	if !strings.HasPrefix(lines[0], "alice:{SSHA}") {
+		t.Fatalf("expected alice password to be hashed, got: %s", lines[0])
+	}
+	if lines[1] != "bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=" {
+		t.Fatalf("expected bob hash to be kept as-is, got: %s", lines[1])
+	}
+
+	if _, err := buildHtpasswd("alice:a\nalice:b"); err == nil {
+		t.Fatalf("expected error for duplicate user")
+	}
+	if _, err := buildHtpasswd("alice"); err == nil {
+		t.Fatalf("expected error for entry without password")
+	}
+}
+
+func TestBuildHtpasswd_PasswordWithComma(t *testing.T) {
+	out, err := buildHtpasswd("carol:pa,ss:word\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	user, hashed, _ := strings.Cut(strings.TrimSpace(out), ":")
+	if user != "carol" {
+		t.Fatalf("expected a single carol entry, got: %q", out)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hashed, "{SSHA}"))
+	if err != nil || len(decoded) <= sha1.Size {
+		t.Fatalf("unexpected hash %q: %v", hashed, err)
+	}
+	sum := sha1.Sum(append([]byte("pa,ss:word"), decoded[sha1.Size:]...))
+	if !bytes.Equal(sum[:], decoded[:sha1.Size]) {
+		t.Fatalf("expected the whole password to be hashed, got: %s", hashed)
+	}
+}
+
+func TestBuildLocationConfig_AuthBasic(t *testing.T) {
+	cfg := &file_config.Config{
+		UserVars: file_config.ConfigVars{},
+		SysVars:  file_config.ConfigVars{},
+		Vhosts: []file_config.VhostConfig{
+			{
+				ServerName: "example.com",
+				AuthBasic:  &file_config.AuthBasicConfig{UsersProperty: "staging-users"},
+				Locations: []file_config.LocationConfig{
+					{
+						Uri:       "/admin/",
+						Body:      "return 200;",
+						AuthBasic: &file_config.AuthBasicConfig{Realm: "Admin", UsersProperty: "admin-users"},
+					},
+				},
+			},
+		},
+	}
+
+	properties := map[string]string{
+		"staging-users": "qa:qa-password",
+		"admin-users":   "root:root-password",
+	}
+
+	locationConfigs, files, err := buildLocationConfig("myapp", cfg, &locationConfigData{
+		releaseDir: "/data/conf.d/release-20011225.1",
+		getProperty: func(appName string, property string) string {
+			return properties[property]
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := locationConfigs["example.com"]
+	if !strings.HasPrefix(out, "auth_basic \"Restricted\";\nauth_basic_user_file /data/conf.d/release-20011225.1/vhosts/example.com/auth_basic/server.htpasswd;") {
+		t.Fatalf("expected server-level auth_basic, got: %s", out)
+	}
+	if !strings.Contains(out, "auth_basic_user_file /data/conf.d/release-20011225.1/vhosts/example.com/auth_basic/location-0.htpasswd;") {
+		t.Fatalf("expected location-level auth_basic, got: %s", out)
+	}
+
+	if !strings.HasPrefix(files["vhosts/example.com/auth_basic/server.htpasswd"], "qa:{SSHA}") {
+		t.Fatalf("expected server htpasswd file, got: %v", files)
+	}
+	if !strings.HasPrefix(files["vhosts/example.com/auth_basic/location-0.htpasswd"], "root:{SSHA}") {
+		t.Fatalf("expected location htpasswd file, got: %v", files)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var fastcgiPassRegexp = regexp.MustCompile(`(?m)^\s*fastcgi_pass\s`)
+
+// nginxVariableName joins parts into a valid nginx variable name (without the
+// leading `$`). App names may contain dashes, which nginx doesn't accept.
+func nginxVariableName(parts ...string) string {
+	name := strings.Join(parts, "_")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+}
+
+// authRequestLocations keeps track of the internal auth subrequest locations of
+// a vhost so locations sharing the same auth endpoint reuse one block.
+type authRequestLocations struct {
+	appName string
+	uris    map[string]string
+	blocks  []string
+}
+
+func newAuthRequestLocations(appName string) *authRequestLocations {
+	return &authRequestLocations{
+		appName: appName,
+		uris:    make(map[string]string),
+	}
+}
+
+func (a *authRequestLocations) locationFor(generatedUpstreamName string, authPath string) string {
+	key := generatedUpstreamName + authPath
+	if uri, ok := a.uris[key]; ok {
+		return uri
+	}
+
+	uri := fmt.Sprintf("/_%s_auth_%d", a.appName, len(a.uris))
+	a.uris[key] = uri
+	a.blocks = append(a.blocks, fmt.Sprintf(`location = %s {
+  internal;
+  proxy_pass http://%s%s;
+  proxy_pass_request_body off;
+  proxy_set_header Content-Length "";
+  proxy_set_header Host $host;
+  proxy_set_header X-Original-URI $request_uri;
+  proxy_set_header X-Original-Method $request_method;
+  proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+}
+`, uri, generatedUpstreamName, authPath))
+	return uri
+}
+
+func (a *authRequestLocations) String() string {
+	return strings.Join(a.blocks, "\n")
+}
+
+// authHeaderLine passes header, held in variable, to the upstream of a
+// location, with the directive of the module the body passes requests with.
+func authHeaderLine(location file_config.LocationConfig, body string, header string, variable string) string {
+	switch {
+	case location.Grpc != nil:
+		return fmt.Sprintf("grpc_set_header %s $%s;", header, variable)
+	case fastcgiPassRegexp.MatchString(body):
+		return fmt.Sprintf("fastcgi_param HTTP_%s $%s;", strings.ToUpper(nginxVariableName(header)), variable)
+	default:
+		return fmt.Sprintf("proxy_set_header %s $%s;", header, variable)
+	}
+}
+
+// buildAuthRequestLines renders the auth_request directives of a location. The
+// internal subrequest location is registered in authLocations.
+func buildAuthRequestLines(appName string, location file_config.LocationConfig, body string, upstreams upstreamResultingNames, authLocations *authRequestLocations) ([]string, error) {
+	authRequest := location.AuthRequest
+	generatedUpstreamName, ok := upstreams[authRequest.Upstream]
+	if !ok {
+		return nil, fmt.Errorf("auth_request upstream %q not found", authRequest.Upstream)
+	}
+
+	lines := []string{
+		fmt.Sprintf("auth_request %s;", authLocations.locationFor(generatedUpstreamName, authRequest.Path)),
+	}
+	for _, header := range authRequest.PassHeaders {
+		variable := nginxVariableName(appName, "auth", header)
+		lines = append(lines,
+			fmt.Sprintf("auth_request_set $%s $upstream_http_%s;", variable, nginxVariableName(header)),
+			authHeaderLine(location, body, header, variable),
+		)
+	}
+	return lines, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_AuthRequest(t *testing.T) {
+	authRequest := &file_config.AuthRequestConfig{
+		Upstream:    "auth",
+		Path:        "/verify",
+		PassHeaders: []string{"X-User-Id"},
+	}
+	newConfig := func(locations ...file_config.LocationConfig) *file_config.Config {
+		return &file_config.Config{
+			UserVars:  file_config.ConfigVars{},
+			SysVars:   file_config.ConfigVars{},
+			Upstreams: []file_config.UpstreamConfig{{Name: "grpc_backend", Protocol: "grpc"}},
+			Vhosts:    []file_config.VhostConfig{{ServerName: "example.com", Http2: true, Locations: locations}},
+		}
+	}
+	newData := func() *locationConfigData {
+		return &locationConfigData{
+			addHeaderMode:  "add_header",
+			http2Supported: true,
+			upstreams:      upstreamResultingNames{"auth": "my-app-auth", "grpc_backend": "my-app-grpc_backend"},
+		}
+	}
+	build := func(t *testing.T, cfg *file_config.Config) string {
+		t.Helper()
+		locationConfigs, _, err := buildLocationConfig("my-app", cfg, newData())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return locationConfigs["example.com"]
+	}
+
+	t.Run("AuthRequest", func(t *testing.T) {
+		out := build(t, newConfig(file_config.LocationConfig{Uri: "/admin/", Body: "proxy_pass http://backend;", AuthRequest: authRequest}))
+		if !strings.Contains(out, "auth_request /_my-app_auth_0;") {
+			t.Errorf("expected auth_request, got: %s", out)
+		}
+		if !strings.Contains(out, "location = /_my-app_auth_0 {\n  internal;\n  proxy_pass http://my-app-auth/verify;") {
+			t.Errorf("expected the internal auth location, got: %s", out)
+		}
+	})
+
+	t.Run("SharedAuthLocation", func(t *testing.T) {
+		out := build(t, newConfig(
+			file_config.LocationConfig{Uri: "/admin/", Body: "proxy_pass http://backend;", AuthRequest: authRequest},
+			file_config.LocationConfig{Uri: "/api/", Body: "proxy_pass http://backend;", AuthRequest: authRequest},
+		))
+		if strings.Count(out, "location = /_my-app_auth_") != 1 {
+			t.Errorf("expected a single internal auth location, got: %s", out)
+		}
+	})
+
+	t.Run("HeaderVariable", func(t *testing.T) {
+		out := build(t, newConfig(file_config.LocationConfig{Uri: "/admin/", Body: "proxy_pass http://backend;", AuthRequest: authRequest}))
+		if !strings.Contains(out, "auth_request_set $my_app_auth_x_user_id $upstream_http_x_user_id;") {
+			t.Errorf("expected auth_request_set, got: %s", out)
+		}
+	})
+
+	t.Run("ProxySetHeader", func(t *testing.T) {
+		out := build(t, newConfig(file_config.LocationConfig{Uri: "/admin/", Body: "proxy_pass http://backend;", AuthRequest: authRequest}))
+		if !strings.Contains(out, "proxy_set_header X-User-Id $my_app_auth_x_user_id;") {
+			t.Errorf("expected proxy_set_header, got: %s", out)
+		}
+	})
+
+	t.Run("GrpcSetHeader", func(t *testing.T) {
+		out := build(t, newConfig(file_config.LocationConfig{Uri: "/helloworld.Greeter/", Grpc: &file_config.GrpcConfig{Upstream: "grpc_backend"}, AuthRequest: authRequest}))
+		if !strings.Contains(out, "grpc_set_header X-User-Id $my_app_auth_x_user_id;") {
+			t.Errorf("expected grpc_set_header, got: %s", out)
+		}
+		if strings.Contains(out, "proxy_set_header X-User-Id") {
+			t.Errorf("expected no proxy_set_header, got: %s", out)
+		}
+	})
+
+	t.Run("FastcgiParam", func(t *testing.T) {
+		out := build(t, newConfig(file_config.LocationConfig{Uri: "~ \\.php$", Body: "include fastcgi_params;\nfastcgi_pass unix:/run/php.sock;", AuthRequest: authRequest}))
+		if !strings.Contains(out, "fastcgi_param HTTP_X_USER_ID $my_app_auth_x_user_id;") {
+			t.Errorf("expected fastcgi_param, got: %s", out)
+		}
+		if strings.Contains(out, "proxy_set_header X-User-Id") {
+			t.Errorf("expected no proxy_set_header, got: %s", out)
+		}
+	})
+
+	t.Run("UnknownUpstream", func(t *testing.T) {
+		cfg := newConfig(file_config.LocationConfig{Uri: "/admin/", Body: "proxy_pass http://backend;", AuthRequest: &file_config.AuthRequestConfig{Upstream: "missing", Path: "/verify"}})
+		if _, _, err := buildLocationConfig("my-app", cfg, newData()); err == nil {
+			t.Errorf("expected error for unknown auth_request upstream")
+		}
+	})
+}
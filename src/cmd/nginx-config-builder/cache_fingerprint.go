@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// nginx uses this key when a location caches without proxy_cache_key. There
+// is no default fastcgi_cache_key.
+const defaultProxyCacheKey = "$scheme$proxy_host$request_uri"
+
+// nginxDirective is a directive of an nginx config, with its block if it has one.
+type nginxDirective struct {
+	args  []string
+	block []nginxDirective
+}
+
+// parseNginxConfig parses the directives of an nginx config. Quoted arguments
+// keep their quotes, so equivalent configs written differently don't compare
+// equal, which errs on the side of purging.
+func parseNginxConfig(content string) ([]nginxDirective, error) {
+	directives, rest, err := parseNginxBlock(content, false)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, errors.New("unexpected \"}\"")
+	}
+	return directives, nil
+}
+
+func parseNginxBlock(content string, inBlock bool) ([]nginxDirective, string, error) {
+	directives := make([]nginxDirective, 0)
+	args := make([]string, 0)
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; c {
+		case ' ', '\t', '\r', '\n':
+		case '#':
+			if end := strings.IndexByte(content[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(content)
+			}
+		case ';':
+			if len(args) == 0 {
+				return nil, "", errors.New("unexpected \";\"")
+			}
+			directives = append(directives, nginxDirective{args: args})
+			args = make([]string, 0)
+		case '{':
+			if len(args) == 0 {
+				return nil, "", errors.New("unexpected \"{\"")
+			}
+			block, rest, err := parseNginxBlock(content[i+1:], true)
+			if err != nil {
+				return nil, "", err
+			}
+			directives = append(directives, nginxDirective{args: args, block: block})
+			args = make([]string, 0)
+			content, i = rest, -1
+		case '}':
+			if !inBlock || len(args) > 0 {
+				return nil, "", errors.New("unexpected \"}\"")
+			}
+			return directives, content[i+1:], nil
+		case '"', '\'':
+			end := i + 1
+			for ; end < len(content) && content[end] != c; end++ {
+				if content[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(content) {
+				return nil, "", errors.New("unterminated quoted string")
+			}
+			args = append(args, content[i:end+1])
+			i = end
+		default:
+			end := i
+			for ; end < len(content) && !strings.ContainsRune(" \t\r\n;{}\"'", rune(content[end])); end++ {
+				// ${var} doesn't open a block
+				if content[end] == '$' && end+1 < len(content) && content[end+1] == '{' {
+					if closing := strings.IndexByte(content[end:], '}'); closing >= 0 {
+						end += closing
+					}
+				}
+			}
+			args = append(args, content[i:end])
+			i = end - 1
+		}
+	}
+	if inBlock {
+		return nil, "", errors.New("unexpected end of file, expecting \"}\"")
+	}
+	if len(args) > 0 {
+		return nil, "", errors.New("unexpected end of file, expecting \";\"")
+	}
+	return directives, "", nil
+}
+
+// collectCacheKeys adds to keys the <kind>_cache_key of every zone used by a
+// <kind>_cache directive, inherited from the enclosing blocks as nginx does.
+func collectCacheKeys(directives []nginxDirective, kind string, key string, keys map[string]map[string]bool) {
+	for _, directive := range directives {
+		if directive.args[0] == kind+"_cache_key" {
+			key = strings.Join(directive.args[1:], " ")
+		}
+	}
+	for _, directive := range directives {
+		if directive.args[0] == kind+"_cache" && len(directive.args) == 2 && directive.args[1] != "off" {
+			zone := directive.args[1]
+			if keys[zone] == nil {
+				keys[zone] = make(map[string]bool)
+			}
+			keys[zone][key] = true
+		}
+		if directive.block != nil {
+			collectCacheKeys(directive.block, kind, key, keys)
+		}
+	}
+}
+
+// collectCacheFlags returns the flags of every <kind>_cache_path, by zone. The
+// path and keys_zone size are left out as changing them doesn't make the
+// cached entries stale.
+func collectCacheFlags(directives []nginxDirective, kind string) map[string][]string {
+	flags := make(map[string][]string)
+	for _, directive := range directives {
+		if directive.args[0] != kind+"_cache_path" || len(directive.args) < 2 {
+			continue
+		}
+		zone := ""
+		zoneFlags := make([]string, 0)
+		for _, arg := range directive.args[2:] {
+			if value, ok := strings.CutPrefix(arg, "keys_zone="); ok {
+				zone, _, _ = strings.Cut(value, ":")
+			} else {
+				zoneFlags = append(zoneFlags, arg)
+			}
+		}
+		sort.Strings(zoneFlags)
+		flags[zone] = zoneFlags
+	}
+	return flags
+}
+
+func cacheFingerprint(flags []string, keys map[string]bool) string {
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "flags %s\n", strings.Join(flags, " "))
+	for _, key := range sortedKeys {
+		fmt.Fprintf(h, "key %s\n", key)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildCacheManifest fingerprints the caches with the flags of their
+// *_cache_path and every key they are used with in the vhost configs, so
+// `purge_on_deploy: on_change` only purges caches whose key or flags changed.
+func buildCacheManifest(cacheConfigs map[string]string, caches map[string]cacheResultingNames, vhostConfigs map[string]string) (nginx_cache.Manifest, error) {
+	manifest := make(nginx_cache.Manifest)
+	for kind, names := range caches {
+		cachePaths, err := parseNginxConfig(cacheConfigs[kind])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s cache config: %w", kind, err)
+		}
+		flags := collectCacheFlags(cachePaths, kind)
+
+		defaultKey := ""
+		if kind == "proxy" {
+			defaultKey = defaultProxyCacheKey
+		}
+		keys := make(map[string]map[string]bool)
+		unparsed := make(map[string]bool)
+		for vhost, vhostConfig := range vhostConfigs {
+			directives, err := parseNginxConfig(vhostConfig)
+			if err != nil {
+				// the whole vhost config then stands for its keys
+				log.Printf("[warn] failed to parse vhost %s config, any change to it changes the %s cache fingerprints: %v\n", vhost, kind, err)
+				sum := sha256.Sum256([]byte(vhostConfig))
+				unparsed[fmt.Sprintf("vhost %s %x", vhost, sum)] = true
+				continue
+			}
+			collectCacheKeys(directives, kind, defaultKey, keys)
+		}
+
+		manifest[kind] = make(map[string]string)
+		for name, zone := range names {
+			zoneKeys := keys[zone]
+			if len(unparsed) > 0 {
+				zoneKeys = make(map[string]bool)
+				for key := range keys[zone] {
+					zoneKeys[key] = true
+				}
+				for key := range unparsed {
+					zoneKeys[key] = true
+				}
+			}
+			manifest[kind][name] = cacheFingerprint(flags[zone], zoneKeys)
+		}
+	}
+	return manifest, nil
+}
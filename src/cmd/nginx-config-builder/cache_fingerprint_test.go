@@ -0,0 +1,181 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/nginx_cache"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNginxConfig(t *testing.T) {
+	directives, err := parseNginxConfig(`
+# comment { ;
+proxy_cache_key "$scheme$host";
+location ~ ^/api/(?<id>\d+)$ {
+  rewrite ^ /v1/${id}_x break;
+  if ($http_x_debug) { return 418 'teapot; }'; }
+}
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []nginxDirective{
+		{args: []string{"proxy_cache_key", `"$scheme$host"`}},
+		{args: []string{"location", "~", `^/api/(?<id>\d+)$`}, block: []nginxDirective{
+			{args: []string{"rewrite", "^", "/v1/${id}_x", "break"}},
+			{args: []string{"if", "($http_x_debug)"}, block: []nginxDirective{
+				{args: []string{"return", "418", "'teapot; }'"}},
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(directives, expected) {
+		t.Errorf("expected %#v, got %#v", expected, directives)
+	}
+
+	for _, invalid := range []string{"location / {", "}", "return 200", "proxy_cache 'a;", "{ }"} {
+		if _, err := parseNginxConfig(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCollectCacheKeys(t *testing.T) {
+	directives, err := parseNginxConfig(`
+proxy_cache_key $host$request_uri;
+location / {
+  proxy_cache proxy_myapp_pages;
+}
+location /api {
+  proxy_cache_key $host$request_uri$http_x_api_key;
+  proxy_cache proxy_myapp_pages;
+}
+location /default {
+  proxy_cache_key $host;
+  location /default/nested {
+    proxy_cache proxy_myapp_other;
+  }
+}
+location /off {
+  proxy_cache off;
+}
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys := make(map[string]map[string]bool)
+	collectCacheKeys(directives, "proxy", defaultProxyCacheKey, keys)
+	expected := map[string]map[string]bool{
+		"proxy_myapp_pages": {"$host$request_uri": true, "$host$request_uri$http_x_api_key": true},
+		"proxy_myapp_other": {"$host": true},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+}
+
+func TestBuildCacheManifest(t *testing.T) {
+	caches := map[string]cacheResultingNames{
+		"proxy":   {"pages": "proxy_myapp_pages", "assets": "proxy_myapp_assets"},
+		"fastcgi": {},
+	}
+	build := func(cacheConfig string, vhostConfig string) nginx_cache.Manifest {
+		manifest, err := buildCacheManifest(
+			map[string]string{"proxy": cacheConfig},
+			caches,
+			map[string]string{"example.com": vhostConfig},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return manifest
+	}
+
+	cacheConfig := "proxy_cache_path /cache/proxy_myapp_pages keys_zone=proxy_myapp_pages:10m levels=1:2 inactive=1h;\n" +
+		"proxy_cache_path /cache/proxy_myapp_assets keys_zone=proxy_myapp_assets:10m levels=1:2;"
+	vhostConfig := "location / {\n  proxy_cache proxy_myapp_pages;\n  proxy_cache_key $host$uri;\n}\nlocation /assets {\n  proxy_cache proxy_myapp_assets;\n}\n"
+	manifest := build(cacheConfig, vhostConfig)
+	if len(manifest["proxy"]) != 2 || len(manifest["fastcgi"]) != 0 {
+		t.Fatalf("unexpected manifest: %v", manifest)
+	}
+
+	// flag order, path and key zone size don't matter
+	same := build("proxy_cache_path /other/pages keys_zone=proxy_myapp_pages:50m inactive=1h levels=1:2;\n"+
+		"proxy_cache_path /cache/proxy_myapp_assets keys_zone=proxy_myapp_assets:10m levels=1:2;", vhostConfig)
+	if !reflect.DeepEqual(same, manifest) {
+		t.Errorf("expected the same fingerprints, got %v and %v", manifest, same)
+	}
+
+	changed := build(cacheConfig, "location / {\n  proxy_cache proxy_myapp_pages;\n  proxy_cache_key $scheme$host$uri;\n}\nlocation /assets {\n  proxy_cache proxy_myapp_assets;\n}\n")
+	if changed["proxy"]["pages"] == manifest["proxy"]["pages"] || changed["proxy"]["assets"] != manifest["proxy"]["assets"] {
+		t.Errorf("expected only the pages fingerprint to change, got %v and %v", manifest, changed)
+	}
+
+	changed = build("proxy_cache_path /cache/proxy_myapp_pages keys_zone=proxy_myapp_pages:10m levels=1:2 inactive=1h;\n"+
+		"proxy_cache_path /cache/proxy_myapp_assets keys_zone=proxy_myapp_assets:10m levels=2;", vhostConfig)
+	if changed["proxy"]["pages"] != manifest["proxy"]["pages"] || changed["proxy"]["assets"] == manifest["proxy"]["assets"] {
+		t.Errorf("expected only the assets fingerprint to change, got %v and %v", manifest, changed)
+	}
+}
+
+// A deploy builds the config several times before the caches are purged, so
+// the purge decision compares with the fingerprints of the last purge, not of
+// the previous build.
+func TestCachePurgeDecision(t *testing.T) {
+	caches := map[string]cacheResultingNames{"proxy": {"pages": "proxy_myapp_pages"}}
+	cacheConfig := "proxy_cache_path /cache/proxy_myapp_pages keys_zone=proxy_myapp_pages:10m levels=1:2;"
+	buildRelease := func(key string) nginx_cache.Manifest {
+		releaseDir := t.TempDir()
+		manifest, err := buildCacheManifest(
+			map[string]string{"proxy": cacheConfig},
+			caches,
+			map[string]string{"example.com": "location / {\n  proxy_cache proxy_myapp_pages;\n  proxy_cache_key " + key + ";\n}\n"},
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		manifestPath := filepath.Join(releaseDir, nginx_cache.ManifestFile)
+		if err := nginx_cache.WriteManifest(manifestPath, manifest); err != nil {
+			t.Fatalf("failed to write manifest: %v", err)
+		}
+		current, err := nginx_cache.ReadManifest(manifestPath)
+		if err != nil {
+			t.Fatalf("failed to read manifest: %v", err)
+		}
+		return current
+	}
+	purgedPath := filepath.Join(t.TempDir(), nginx_cache.PurgedManifestFile)
+	deploy := func(key string, builds int) []string {
+		var current nginx_cache.Manifest
+		for i := 0; i < builds; i++ {
+			current = buildRelease(key)
+		}
+		purged, err := nginx_cache.ReadManifest(purgedPath)
+		if err != nil {
+			t.Fatalf("failed to read purged manifest: %v", err)
+		}
+		changed := nginx_cache.ChangedCaches(current, purged, "proxy", []string{"pages"})
+		if purged == nil {
+			purged = make(nginx_cache.Manifest)
+		}
+		for _, name := range changed {
+			purged.RecordPurge(current, "proxy", name)
+		}
+		if err := nginx_cache.WriteManifest(purgedPath, purged); err != nil {
+			t.Fatalf("failed to write purged manifest: %v", err)
+		}
+		return changed
+	}
+
+	if changed := deploy("$host$uri", 1); !reflect.DeepEqual(changed, []string{"pages"}) {
+		t.Errorf("expected a cache never purged to be purged, got %v", changed)
+	}
+	if changed := deploy("$host$uri", 2); len(changed) != 0 {
+		t.Errorf("expected no purge without a change, got %v", changed)
+	}
+	if changed := deploy("$host$request_uri", 2); !reflect.DeepEqual(changed, []string{"pages"}) {
+		t.Errorf("expected a key change to purge even after several builds, got %v", changed)
+	}
+	if changed := deploy("$host$request_uri", 1); len(changed) != 0 {
+		t.Errorf("expected the purge to be recorded, got %v", changed)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheWarmDefaultAddress     = "127.0.0.1"
+	cacheWarmDefaultConcurrency = 4
+	cacheWarmRequestTimeout     = 30 * time.Second
+)
+
+// warmRequest is a page to request, with the Host header nginx routes it by
+// and the scheme of the listener it is served on.
+type warmRequest struct {
+	scheme string
+	host   string
+	path   string
+}
+
+type warmFailure struct {
+	request warmRequest
+	err     error
+}
+
+type sitemapURLSet struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+// parseSitemap returns the pages of a sitemap, with the scheme and host of
+// their URL.
+// Sitemap indexes are not followed.
+func parseSitemap(content []byte) ([]warmRequest, error) {
+	urlSet := sitemapURLSet{}
+	if err := xml.Unmarshal(content, &urlSet); err != nil {
+		return nil, fmt.Errorf("invalid sitemap: %w", err)
+	}
+	requests := make([]warmRequest, 0, len(urlSet.URLs))
+	for _, u := range urlSet.URLs {
+		loc, err := url.Parse(strings.TrimSpace(u.Loc))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sitemap url %q: %w", u.Loc, err)
+		}
+		requests = append(requests, warmRequest{scheme: loc.Scheme, host: loc.Host, path: loc.RequestURI()})
+	}
+	return requests, nil
+}
+
+// buildWarmRequests returns the pages to request for a cache, requested with
+// defaultHost unless the config sets a host, and with defaultScheme unless
+// their sitemap URL has one.
+func buildWarmRequests(warm *file_config.CacheWarmConfig, defaultHost string, defaultScheme string, readImageFile imageFileReader) ([]warmRequest, error) {
+	requests := make([]warmRequest, 0, len(warm.Paths))
+	for _, p := range warm.Paths {
+		requests = append(requests, warmRequest{path: p})
+	}
+	if warm.Sitemap != "" {
+		content, err := readImageFile(warm.Sitemap)
+		if err != nil {
+			return nil, err
+		}
+		sitemapRequests, err := parseSitemap(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", warm.Sitemap, err)
+		}
+		requests = append(requests, sitemapRequests...)
+	}
+
+	seen := make(map[warmRequest]bool)
+	unique := requests[:0]
+	for _, request := range requests {
+		if warm.Host != "" {
+			request.host = warm.Host
+		} else if request.host == "" {
+			request.host = defaultHost
+		}
+		if request.scheme == "" {
+			request.scheme = defaultScheme
+		}
+		if !seen[request] {
+			seen[request] = true
+			unique = append(unique, request)
+		}
+	}
+	return unique, nil
+}
+
+// newWarmClient returns a client for the pages of host. It connects to the
+// local listener, so the certificate, issued for the vhost, is not verified.
+func newWarmClient(host string) *http.Client {
+	serverName := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		serverName = h
+	}
+	return &http.Client{
+		Timeout: cacheWarmRequestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// warmUrl returns the URL a page is requested at: on base_url when it is set,
+// else on the local nginx listener of the page scheme.
+func warmUrl(baseUrl *url.URL, request warmRequest) string {
+	if baseUrl == nil {
+		return request.scheme + "://" + cacheWarmDefaultAddress + request.path
+	}
+	return strings.TrimSuffix(baseUrl.String(), "/") + request.path
+}
+
+func warmPage(client *http.Client, baseUrl *url.URL, request warmRequest) error {
+	req, err := http.NewRequest(http.MethodGet, warmUrl(baseUrl, request), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = request.host
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// nginx only caches a response once it has been read entirely
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	// redirects are not followed, so the page itself was not cached
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// warmCache requests every page with concurrency workers and returns the
+// failed ones. A nil baseUrl requests the local nginx listeners.
+func warmCache(baseUrl *url.URL, requests []warmRequest, concurrency int) []warmFailure {
+	var (
+		mu       sync.Mutex
+		failures []warmFailure
+		wg       sync.WaitGroup
+	)
+	queue := make(chan warmRequest)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// connections are pooled by listener address, so each host
+			// needs its own client to get its TLS server name
+			clients := make(map[string]*http.Client)
+			for request := range queue {
+				client, ok := clients[request.host]
+				if !ok {
+					client = newWarmClient(request.host)
+					clients[request.host] = client
+				}
+				if err := warmPage(client, baseUrl, request); err != nil {
+					mu.Lock()
+					failures = append(failures, warmFailure{request: request, err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, request := range requests {
+		queue <- request
+	}
+	close(queue)
+	wg.Wait()
+	return failures
+}
+
+// runCacheWarm warms every cache with warm_on_deploy. Failures are reported
+// but don't fail the deploy, and it returns the number of failed requests.
+func runCacheWarm(cfg *file_config.Config, readImageFile imageFileReader) (int, error) {
+	defaultHost := ""
+	defaultScheme := "http"
+	if len(cfg.Vhosts) > 0 {
+		if names := strings.Fields(cfg.Vhosts[0].ServerName); len(names) > 0 {
+			defaultHost = names[0]
+		}
+		if cfg.Vhosts[0].Tls != nil {
+			defaultScheme = "https"
+		}
+	}
+
+	failed := 0
+	for kind, caches := range map[string][]file_config.CacheConfig{"proxy": cfg.ProxyCaches, "fastcgi": cfg.FastcgiCaches} {
+		for _, cache := range caches {
+			if cache.WarmOnDeploy == nil {
+				continue
+			}
+			warm := cache.WarmOnDeploy
+
+			var baseUrl *url.URL
+			if warm.BaseUrl != "" {
+				u, err := url.Parse(warm.BaseUrl)
+				if err != nil {
+					return failed, fmt.Errorf("%s cache %q: invalid base_url: %w", kind, cache.Name, err)
+				}
+				baseUrl = u
+			}
+			concurrency := warm.Concurrency
+			if concurrency == 0 {
+				concurrency = cacheWarmDefaultConcurrency
+			}
+
+			requests, err := buildWarmRequests(warm, defaultHost, defaultScheme, readImageFile)
+			if err != nil {
+				log.Printf("[warn] %s cache %q: not warming: %v\n", kind, cache.Name, err)
+				failed++
+				continue
+			}
+
+			start := time.Now()
+			failures := warmCache(baseUrl, requests, concurrency)
+			for _, failure := range failures {
+				log.Printf("[warn] %s cache %q: failed to warm %s%s: %v\n", kind, cache.Name, failure.request.host, failure.request.path, failure.err)
+			}
+			log.Printf("[info] %s cache %q: warmed %d/%d pages in %s\n", kind, cache.Name, len(requests)-len(failures), len(requests), time.Since(start).Round(time.Millisecond))
+			failed += len(failures)
+		}
+	}
+	return failed, nil
+}
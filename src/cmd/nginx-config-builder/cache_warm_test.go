@@ -0,0 +1,160 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestParseSitemap(t *testing.T) {
+	sitemap := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc></url>
+  <url>
+    <loc>
+      https://www.example.com/blog/post?page=2
+    </loc>
+    <lastmod>2024-01-01</lastmod>
+  </url>
+</urlset>`
+	requests, err := parseSitemap([]byte(sitemap))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []warmRequest{
+		{scheme: "https", host: "example.com", path: "/"},
+		{scheme: "https", host: "www.example.com", path: "/blog/post?page=2"},
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected %v, got %v", expected, requests)
+	}
+
+	if _, err := parseSitemap([]byte("<urlset><url>")); err == nil {
+		t.Errorf("expected an error for an invalid sitemap")
+	}
+}
+
+func TestBuildWarmRequests(t *testing.T) {
+	readImageFile := func(filePath string) ([]byte, error) {
+		if filePath != "public/sitemap.xml" {
+			return nil, errors.New("not found")
+		}
+		return []byte(`<urlset><url><loc>https://shop.example.com/</loc></url><url><loc>http://example.com/about</loc></url><url><loc>/contact</loc></url></urlset>`), nil
+	}
+
+	requests, err := buildWarmRequests(&file_config.CacheWarmConfig{
+		Paths:   []string{"/", "/about"},
+		Sitemap: "public/sitemap.xml",
+	}, "example.com", "https", readImageFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []warmRequest{
+		{scheme: "https", host: "example.com", path: "/"},
+		{scheme: "https", host: "example.com", path: "/about"},
+		{scheme: "https", host: "shop.example.com", path: "/"},
+		{scheme: "http", host: "example.com", path: "/about"},
+		{scheme: "https", host: "example.com", path: "/contact"},
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected %v, got %v", expected, requests)
+	}
+
+	requests, err = buildWarmRequests(&file_config.CacheWarmConfig{
+		Sitemap: "public/sitemap.xml",
+		Host:    "internal.example.com",
+	}, "example.com", "http", readImageFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []warmRequest{
+		{scheme: "https", host: "internal.example.com", path: "/"},
+		{scheme: "http", host: "internal.example.com", path: "/about"},
+		{scheme: "http", host: "internal.example.com", path: "/contact"},
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected the configured host to override the sitemap ones, got %v", requests)
+	}
+
+	if _, err := buildWarmRequests(&file_config.CacheWarmConfig{Sitemap: "missing.xml"}, "example.com", "http", readImageFile); err == nil {
+		t.Errorf("expected an error for a missing sitemap")
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		requested []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Host+r.URL.RequestURI())
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		case "/moved":
+			http.Redirect(w, r, "/", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	baseUrl, _ := url.Parse(server.URL)
+
+	failures := warmCache(baseUrl, []warmRequest{
+		{host: "example.com", path: "/"},
+		{host: "example.com", path: "/blog?page=2"},
+		{host: "shop.example.com", path: "/missing"},
+		{host: "example.com", path: "/moved"},
+	}, 2)
+
+	sort.Strings(requested)
+	expected := []string{"example.com/", "example.com/blog?page=2", "example.com/moved", "shop.example.com/missing"}
+	if !reflect.DeepEqual(requested, expected) {
+		t.Errorf("expected requests %v, got %v", expected, requested)
+	}
+	failed := make(map[string]string)
+	for _, failure := range failures {
+		failed[failure.request.path] = failure.err.Error()
+	}
+	expectedFailures := map[string]string{"/missing": "status 404", "/moved": "status 301"}
+	if !reflect.DeepEqual(failed, expectedFailures) {
+		t.Errorf("expected failures %v, got %v", expectedFailures, failed)
+	}
+}
+
+func TestWarmCacheUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	baseUrl, _ := url.Parse(server.URL)
+	server.Close()
+
+	failures := warmCache(baseUrl, []warmRequest{{host: "example.com", path: "/"}}, 4)
+	if len(failures) != 1 {
+		t.Fatalf("expected the request to fail, got %v", failures)
+	}
+}
+
+func TestWarmUrl(t *testing.T) {
+	request := warmRequest{scheme: "https", host: "example.com", path: "/blog?page=2"}
+
+	t.Run("LocalListener", func(t *testing.T) {
+		if u := warmUrl(nil, request); u != "https://127.0.0.1/blog?page=2" {
+			t.Errorf("expected the local https listener, got %s", u)
+		}
+	})
+
+	t.Run("BaseUrl", func(t *testing.T) {
+		baseUrl, _ := url.Parse("http://10.0.0.1:8080/")
+		if u := warmUrl(baseUrl, request); u != "http://10.0.0.1:8080/blog?page=2" {
+			t.Errorf("expected the configured base_url, got %s", u)
+		}
+	})
+}
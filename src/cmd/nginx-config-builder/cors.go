@@ -0,0 +1,123 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var corsDefaultMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// effectiveCors returns the CORS policy applying to a location: its own, or the
+// one inherited from the vhost.
+func effectiveCors(vhost file_config.VhostConfig, location file_config.LocationConfig) *file_config.CorsConfig {
+	if location.Cors != nil {
+		return location.Cors
+	}
+	if location.Uri == "" && location.Named == "" {
+		return nil
+	}
+	return vhost.Cors
+}
+
+// corsOriginVariable is the name of the map variable holding the allowed origin
+// for a location. Locations inheriting the vhost policy share the vhost variable.
+func corsOriginVariable(appName string, vhost file_config.VhostConfig, locationIndex int) string {
+	scope := "server"
+	if vhost.Locations[locationIndex].Cors != nil {
+		scope = strconv.Itoa(locationIndex)
+	}
+	return nginxVariableName(appName, "cors_origin", vhost.ServerName, scope)
+}
+
+func buildCorsMapLines(cors *file_config.CorsConfig) []string {
+	defaultValue := `""`
+	lines := make([]string, 0)
+	for _, origin := range cors.Origins {
+		if origin == "*" {
+			// never with credentials, see file_config.validateCors
+			defaultValue = "*"
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s $http_origin;", nginxQuote(origin)))
+	}
+	if cors.OriginRegex != "" {
+		lines = append(lines, fmt.Sprintf("%s $http_origin;", nginxQuote("~"+cors.OriginRegex)))
+	}
+	return append([]string{fmt.Sprintf("default %s;", defaultValue)}, lines...)
+}
+
+// buildCorsMapConfig renders the origin maps of every CORS policy in the config.
+func buildCorsMapConfig(appName string, config *file_config.Config) (string, error) {
+	cfgStr := ""
+	seen := make(map[string]bool)
+
+	for _, vhost := range config.Vhosts {
+		for locationIndex, location := range vhost.Locations {
+			cors := effectiveCors(vhost, location)
+			if cors == nil {
+				continue
+			}
+			variable := corsOriginVariable(appName, vhost, locationIndex)
+			if seen[variable] {
+				continue
+			}
+			seen[variable] = true
+
+			cfgStr += fmt.Sprintf("map $http_origin $%s {\n", variable)
+			for _, line := range buildCorsMapLines(cors) {
+				cfgStr += fmt.Sprintf("  %s\n", line)
+			}
+			cfgStr += "}\n"
+		}
+	}
+
+	return cfgStr, nil
+}
+
+// buildCorsLines renders the CORS response headers and the OPTIONS preflight
+// branch of a location.
+func buildCorsLines(cors *file_config.CorsConfig, originVariable string, addHeaderMode string) []string {
+	headers := [][2]string{
+		{"Access-Control-Allow-Origin", "$" + originVariable},
+		{"Vary", "Origin"},
+	}
+	if cors.Credentials {
+		headers = append(headers, [2]string{"Access-Control-Allow-Credentials", "true"})
+	}
+	if len(cors.ExposeHeaders) > 0 {
+		headers = append(headers, [2]string{"Access-Control-Expose-Headers", nginxHeaderValue(addHeaderMode, strings.Join(cors.ExposeHeaders, ", "))})
+	}
+
+	methods := cors.Methods
+	if len(methods) == 0 {
+		methods = corsDefaultMethods
+	}
+	allowHeaders := "$http_access_control_request_headers"
+	if len(cors.Headers) > 0 {
+		allowHeaders = nginxHeaderValue(addHeaderMode, strings.Join(cors.Headers, ", "))
+	}
+	preflightHeaders := append(append([][2]string{}, headers...),
+		[2]string{"Access-Control-Allow-Methods", nginxHeaderValue(addHeaderMode, strings.Join(methods, ", "))},
+		[2]string{"Access-Control-Allow-Headers", allowHeaders},
+	)
+	if cors.MaxAge > 0 {
+		preflightHeaders = append(preflightHeaders, [2]string{"Access-Control-Max-Age", strconv.Itoa(cors.MaxAge)})
+	}
+
+	lines := make([]string, 0)
+	for _, h := range headers {
+		lines = append(lines, nginxAddHeader(addHeaderMode, h[0], h[1]))
+	}
+
+	// add_header directives inside `if` replace the location ones, so the
+	// preflight branch repeats every CORS header.
+	lines = append(lines, "if ($request_method = OPTIONS) {")
+	for _, h := range preflightHeaders {
+		lines = append(lines, "  "+nginxAddHeader(addHeaderMode, h[0], h[1]))
+	}
+	lines = append(lines, "  return 204;", "}")
+
+	return lines
+}
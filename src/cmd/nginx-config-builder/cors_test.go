@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildCorsConfig(t *testing.T) {
+	cfg := &file_config.Config{
+		UserVars: file_config.ConfigVars{},
+		SysVars:  file_config.ConfigVars{},
+		Vhosts: []file_config.VhostConfig{
+			{
+				ServerName: "api.example.com",
+				Cors: &file_config.CorsConfig{
+					Origins:     []string{"https://app.example.com"},
+					OriginRegex: `^https://.*\.preview\.example\.com$`,
+					Credentials: true,
+					MaxAge:      600,
+				},
+				Locations: []file_config.LocationConfig{
+					{Uri: "/", Body: "return 200;"},
+					{Uri: "/public/", Body: "return 200;", Cors: &file_config.CorsConfig{Origins: []string{"*"}}},
+					{Body: "# raw body"},
+				},
+			},
+		},
+	}
+
+	mapCfg, err := buildCorsMapConfig("my-app", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	locationConfigs, _, err := buildLocationConfig("my-app", cfg, &locationConfigData{addHeaderMode: "add_header"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := locationConfigs["api.example.com"]
+	root := nginxBlock(out, "location /")
+	public := nginxBlock(out, "location /public/")
+
+	t.Run("OriginMap", func(t *testing.T) {
+		block := nginxBlock(mapCfg, "map $http_origin $my_app_cors_origin_api_example_com_server")
+		for _, entry := range []string{
+			`default "";`,
+			`"https://app.example.com" $http_origin;`,
+			`"~^https://.*\\.preview\\.example\\.com$" $http_origin;`,
+		} {
+			if !strings.Contains(block, entry) {
+				t.Errorf("expected %q in the origin map, got: %s", entry, mapCfg)
+			}
+		}
+	})
+
+	t.Run("AnyOriginMap", func(t *testing.T) {
+		block := nginxBlock(mapCfg, "map $http_origin $my_app_cors_origin_api_example_com_1")
+		if !strings.Contains(block, "default *;") {
+			t.Errorf("expected any origin to be allowed, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("AllowOrigin", func(t *testing.T) {
+		if !strings.Contains(root, "add_header Access-Control-Allow-Origin $my_app_cors_origin_api_example_com_server always;") {
+			t.Errorf("expected the vhost origin variable, got: %s", root)
+		}
+		if !strings.Contains(public, "add_header Access-Control-Allow-Origin $my_app_cors_origin_api_example_com_1 always;") {
+			t.Errorf("expected the location origin variable, got: %s", public)
+		}
+	})
+
+	t.Run("Credentials", func(t *testing.T) {
+		if !strings.Contains(root, "add_header Access-Control-Allow-Credentials true always;") {
+			t.Errorf("expected Access-Control-Allow-Credentials, got: %s", root)
+		}
+		if strings.Contains(public, "Access-Control-Allow-Credentials") {
+			t.Errorf("expected no credentials for any origin, got: %s", public)
+		}
+	})
+
+	t.Run("Preflight", func(t *testing.T) {
+		preflight := nginxBlock(root, "if ($request_method = OPTIONS)")
+		for _, directive := range []string{
+			"add_header Access-Control-Allow-Methods \"GET, POST, PUT, PATCH, DELETE, OPTIONS\" always;",
+			"add_header Access-Control-Max-Age 600 always;",
+			"return 204;",
+		} {
+			if !strings.Contains(preflight, directive) {
+				t.Errorf("expected %q in the preflight branch, got: %s", directive, root)
+			}
+		}
+	})
+
+	t.Run("RawBodyLocation", func(t *testing.T) {
+		if strings.Count(out, "if ($request_method = OPTIONS)") != 2 {
+			t.Errorf("expected preflight branches only in uri locations, got: %s", out)
+		}
+	})
+}
+
+func TestBuildCorsLines_MoreSetHeaders(t *testing.T) {
+	lines := buildCorsLines(&file_config.CorsConfig{Origins: []string{"*"}, Headers: []string{"Authorization", "Content-Type"}}, "v", "more_set_headers")
+	out := strings.Join(lines, "\n")
+	if !strings.Contains(out, `more_set_headers "Access-Control-Allow-Headers: Authorization, Content-Type";`) {
+		t.Fatalf("expected more_set_headers directives, got: %s", out)
+	}
+}
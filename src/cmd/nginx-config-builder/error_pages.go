@@ -0,0 +1,83 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/sigil"
+)
+
+func errorPagesLocation(appName string) string {
+	return fmt.Sprintf("/_%s_error_pages/", appName)
+}
+
+// buildErrorPagesConfig renders the error_page directives and the internal
+// location of a vhost. The pages are registered in files, under the vhost
+// directory of the release.
+func buildErrorPagesConfig(appName string, config *file_config.Config, vhost file_config.VhostConfig, data *locationConfigData, files releaseFiles) (string, error) {
+	if len(vhost.ErrorPages) == 0 {
+		return "", nil
+	}
+
+	pagesDir := fmt.Sprintf("vhosts/%s/error_pages", vhost.ServerName)
+	seen := make(map[int]bool)
+	cfgStr := ""
+
+	for i, page := range vhost.ErrorPages {
+		codes := make([]string, 0, len(page.Codes))
+		for _, code := range page.Codes {
+			if seen[code] {
+				return "", fmt.Errorf("error_pages #%d: status code %d is already mapped", i, code)
+			}
+			seen[code] = true
+			codes = append(codes, strconv.Itoa(code))
+		}
+
+		if data.readImageFile == nil {
+			return "", fmt.Errorf("error_pages #%d: image files are not available", i)
+		}
+		source := page.File
+		if source == "" {
+			source = page.Template
+		}
+		content, err := data.readImageFile(source)
+		if err != nil {
+			return "", fmt.Errorf("error_pages #%d: %w", i, err)
+		}
+
+		if page.Template != "" {
+			rendered, err := sigil.Execute(content, map[string]any{
+				"vars":         config.UserVars,
+				"sys_vars":     config.SysVars,
+				"page":         page.Vars,
+				"status_codes": page.Codes,
+				"server_name":  vhost.ServerName,
+			}, fmt.Sprintf("error_page_vhost_%s_%d", vhost.ServerName, i))
+			if err != nil {
+				return "", fmt.Errorf("error_pages #%d: failed to render template %s: %w", i, page.Template, err)
+			}
+			content = rendered.Bytes()
+		}
+
+		filename := fmt.Sprintf("error-%s.html", strings.Join(codes, "-"))
+		files[path.Join(pagesDir, filename)] = string(content)
+		cfgStr += fmt.Sprintf("error_page %s %s%s;\n", strings.Join(codes, " "), errorPagesLocation(appName), filename)
+	}
+
+	if vhost.InterceptErrors {
+		cfgStr += "proxy_intercept_errors on;\nfastcgi_intercept_errors on;\n"
+	}
+
+	cfgStr += fmt.Sprintf(`
+location ^~ %s {
+  internal;
+  alias %s/;
+}
+
+`, errorPagesLocation(appName), path.Join(data.releaseDir, pagesDir))
+
+	return cfgStr, nil
+}
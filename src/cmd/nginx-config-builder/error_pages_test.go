@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildErrorPagesConfig(t *testing.T) {
+	images := map[string]string{
+		"public/404.html":          "<h1>Not found</h1>",
+		".dokku/5xx.html.sigil":    "<h1 style=\"color: {{ .page.color }}\">{{ .vars.brand }} is down</h1>",
+		".dokku/broken.html.sigil": "{{ .page.color",
+	}
+	data := &locationConfigData{
+		releaseDir: "/var/lib/nginx/myapp/release-20240101.1",
+		readImageFile: func(p string) ([]byte, error) {
+			content, ok := images[p]
+			if !ok {
+				return nil, fmt.Errorf("file %s not found", p)
+			}
+			return []byte(content), nil
+		},
+	}
+	cfg := &file_config.Config{UserVars: file_config.ConfigVars{"brand": "Acme"}, SysVars: file_config.ConfigVars{}}
+	newVhost := func(errorPages ...file_config.ErrorPageConfig) file_config.VhostConfig {
+		return file_config.VhostConfig{ServerName: "example.com", InterceptErrors: true, ErrorPages: errorPages}
+	}
+	filePage := file_config.ErrorPageConfig{Codes: []int{404}, File: "public/404.html"}
+	templatePage := file_config.ErrorPageConfig{Codes: []int{502, 503}, Template: ".dokku/5xx.html.sigil", Vars: map[string]any{"color": "red"}}
+
+	files := make(releaseFiles)
+	out, err := buildErrorPagesConfig("myapp", cfg, newVhost(filePage, templatePage), data, files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("ErrorPage", func(t *testing.T) {
+		for _, directive := range []string{
+			"error_page 404 /_myapp_error_pages/error-404.html;",
+			"error_page 502 503 /_myapp_error_pages/error-502-503.html;",
+		} {
+			if !strings.Contains(out, directive) {
+				t.Errorf("expected %q, got: %s", directive, out)
+			}
+		}
+	})
+
+	t.Run("InterceptErrors", func(t *testing.T) {
+		if !strings.Contains(out, "proxy_intercept_errors on;") {
+			t.Errorf("expected proxy_intercept_errors, got: %s", out)
+		}
+	})
+
+	t.Run("ErrorPagesLocation", func(t *testing.T) {
+		location := nginxBlock(out, "location ^~ /_myapp_error_pages/")
+		for _, directive := range []string{"internal;", "alias /var/lib/nginx/myapp/release-20240101.1/vhosts/example.com/error_pages/;"} {
+			if !strings.Contains(location, directive) {
+				t.Errorf("expected %q, got: %s", directive, out)
+			}
+		}
+	})
+
+	t.Run("FilePage", func(t *testing.T) {
+		if page := files["vhosts/example.com/error_pages/error-404.html"]; page != "<h1>Not found</h1>" {
+			t.Errorf("unexpected 404 page: %q", page)
+		}
+	})
+
+	t.Run("TemplatePage", func(t *testing.T) {
+		if page := files["vhosts/example.com/error_pages/error-502-503.html"]; page != "<h1 style=\"color: red\">Acme is down</h1>" {
+			t.Errorf("unexpected 5xx page: %q", page)
+		}
+	})
+
+	t.Run("DuplicateCode", func(t *testing.T) {
+		duplicate := file_config.ErrorPageConfig{Codes: []int{503}, File: "public/404.html"}
+		if _, err := buildErrorPagesConfig("myapp", cfg, newVhost(filePage, templatePage, duplicate), data, make(releaseFiles)); err == nil || !strings.Contains(err.Error(), "already mapped") {
+			t.Errorf("expected duplicate code error, got: %v", err)
+		}
+	})
+
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		broken := file_config.ErrorPageConfig{Codes: []int{500}, Template: ".dokku/broken.html.sigil"}
+		if _, err := buildErrorPagesConfig("myapp", cfg, newVhost(broken), data, make(releaseFiles)); err == nil {
+			t.Errorf("expected template error")
+		}
+	})
+}
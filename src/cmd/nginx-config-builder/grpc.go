@@ -0,0 +1,113 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const grpcDefaultReadTimeout = "300s"
+const grpcDefaultSendTimeout = "300s"
+
+// grpcErrorStatuses maps the errors nginx itself returns to gRPC status codes,
+// following https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md.
+var grpcErrorStatuses = []struct {
+	grpcStatus   int
+	message      string
+	httpStatuses []int
+}{
+	{13, "internal", []int{400}},
+	{16, "unauthenticated", []int{401}},
+	{7, "permission denied", []int{403}},
+	{12, "unimplemented", []int{404}},
+	{14, "unavailable", []int{429, 502, 503, 504}},
+}
+
+func grpcErrorLocationName(appName string, grpcStatus int) string {
+	return fmt.Sprintf("%s_grpc_status_%d", appName, grpcStatus)
+}
+
+// buildGrpcErrorLocations renders the named locations answering nginx errors
+// with a gRPC status, so clients get a proper gRPC error instead of an HTML
+// page.
+func buildGrpcErrorLocations(appName string, addHeaderMode string) string {
+	cfgStr := ""
+	for _, status := range grpcErrorStatuses {
+		cfgStr += fmt.Sprintf(`location @%s {
+  default_type application/grpc;
+  %s
+  %s
+  return 204;
+}
+`, grpcErrorLocationName(appName, status.grpcStatus),
+			nginxAddHeader(addHeaderMode, "grpc-status", strconv.Itoa(status.grpcStatus)),
+			nginxAddHeader(addHeaderMode, "grpc-message", nginxHeaderValue(addHeaderMode, status.message)))
+	}
+	return cfgStr
+}
+
+// grpcUpstreamScheme returns the grpc_pass scheme of an upstream, which must be
+// declared in upstreams with protocol grpc or grpcs.
+func grpcUpstreamScheme(config *file_config.Config, upstreamName string) (string, error) {
+	for _, upstream := range config.Upstreams {
+		if upstream.Name != upstreamName {
+			continue
+		}
+		switch upstream.Protocol {
+		case "grpc", "grpcs":
+			return upstream.Protocol, nil
+		case "":
+			return "", fmt.Errorf("upstream %q has no protocol, set protocol: grpc or grpcs", upstreamName)
+		}
+		return "", fmt.Errorf("upstream %q has protocol %s, set protocol: grpc or grpcs", upstreamName, upstream.Protocol)
+	}
+	return "", fmt.Errorf("grpc upstream %q must be declared in upstreams with protocol: grpc or grpcs", upstreamName)
+}
+
+// buildGrpcLines renders the grpc_pass directives of a location.
+func buildGrpcLines(appName string, config *file_config.Config, vhost file_config.VhostConfig, grpc *file_config.GrpcConfig, data *locationConfigData) ([]string, error) {
+	if !vhost.Http2 || !data.http2Supported {
+		return nil, fmt.Errorf("grpc requires http2: true on the vhost and nginx with HTTP/2 support")
+	}
+	generatedUpstreamName, ok := data.upstreams[grpc.Upstream]
+	if !ok {
+		return nil, fmt.Errorf("grpc upstream %q not found", grpc.Upstream)
+	}
+	scheme, err := grpcUpstreamScheme(config, grpc.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	readTimeout := grpc.ReadTimeout
+	if readTimeout == "" {
+		readTimeout = grpcDefaultReadTimeout
+	}
+	sendTimeout := grpc.SendTimeout
+	if sendTimeout == "" {
+		sendTimeout = grpcDefaultSendTimeout
+	}
+
+	lines := []string{
+		fmt.Sprintf("grpc_pass %s://%s;", scheme, generatedUpstreamName),
+		"grpc_set_header X-Real-IP $remote_addr;",
+		"grpc_set_header X-Forwarded-For $proxy_add_x_forwarded_for;",
+		"grpc_set_header X-Forwarded-Proto $scheme;",
+	}
+	if grpc.ConnectTimeout != "" {
+		lines = append(lines, fmt.Sprintf("grpc_connect_timeout %s;", grpc.ConnectTimeout))
+	}
+	lines = append(lines,
+		fmt.Sprintf("grpc_read_timeout %s;", readTimeout),
+		fmt.Sprintf("grpc_send_timeout %s;", sendTimeout),
+	)
+	for _, status := range grpcErrorStatuses {
+		codes := make([]string, 0, len(status.httpStatuses))
+		for _, code := range status.httpStatuses {
+			codes = append(codes, strconv.Itoa(code))
+		}
+		lines = append(lines, fmt.Sprintf("error_page %s = @%s;", strings.Join(codes, " "), grpcErrorLocationName(appName, status.grpcStatus)))
+	}
+
+	return lines, nil
+}
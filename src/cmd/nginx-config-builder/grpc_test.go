@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_Grpc(t *testing.T) {
+	newConfig := func(grpc *file_config.GrpcConfig) *file_config.Config {
+		return &file_config.Config{
+			UserVars: file_config.ConfigVars{},
+			SysVars:  file_config.ConfigVars{},
+			Upstreams: []file_config.UpstreamConfig{
+				{Name: "grpc_backend", Protocol: "grpc"},
+				{Name: "secure_backend", Protocol: "grpcs"},
+				{Name: "web_backend", Protocol: "http"},
+				{Name: "plain_backend"},
+			},
+			Vhosts: []file_config.VhostConfig{{
+				ServerName: "example.com",
+				Http2:      true,
+				Locations:  []file_config.LocationConfig{{Uri: "/helloworld.Greeter/", Grpc: grpc}},
+			}},
+		}
+	}
+	newData := func() *locationConfigData {
+		return &locationConfigData{
+			addHeaderMode:  "add_header",
+			http2Supported: true,
+			upstreams: upstreamResultingNames{
+				"grpc_backend":   "myapp-grpc_backend",
+				"secure_backend": "myapp-secure_backend",
+				"web_backend":    "myapp-web_backend",
+				"plain_backend":  "myapp-plain_backend",
+				"web-5000":       "myapp-web-5000",
+			},
+		}
+	}
+	build := func(t *testing.T, cfg *file_config.Config, data *locationConfigData) string {
+		t.Helper()
+		locationConfigs, _, err := buildLocationConfig("myapp", cfg, data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return locationConfigs["example.com"]
+	}
+	buildErr := func(cfg *file_config.Config, data *locationConfigData) error {
+		_, _, err := buildLocationConfig("myapp", cfg, data)
+		return err
+	}
+
+	t.Run("GrpcPass", func(t *testing.T) {
+		out := build(t, newConfig(&file_config.GrpcConfig{Upstream: "grpc_backend"}), newData())
+		if !strings.Contains(out, "grpc_pass grpc://myapp-grpc_backend;") {
+			t.Errorf("expected grpc_pass, got: %s", out)
+		}
+	})
+
+	t.Run("GrpcsPass", func(t *testing.T) {
+		out := build(t, newConfig(&file_config.GrpcConfig{Upstream: "secure_backend"}), newData())
+		if !strings.Contains(out, "grpc_pass grpcs://myapp-secure_backend;") {
+			t.Errorf("expected grpcs grpc_pass, got: %s", out)
+		}
+	})
+
+	t.Run("Timeouts", func(t *testing.T) {
+		out := build(t, newConfig(&file_config.GrpcConfig{Upstream: "grpc_backend", ReadTimeout: "1h", ConnectTimeout: "5s"}), newData())
+		for _, directive := range []string{"grpc_read_timeout 1h;", "grpc_send_timeout 300s;", "grpc_connect_timeout 5s;"} {
+			if !strings.Contains(out, directive) {
+				t.Errorf("expected %q, got: %s", directive, out)
+			}
+		}
+	})
+
+	t.Run("ErrorStatuses", func(t *testing.T) {
+		out := build(t, newConfig(&file_config.GrpcConfig{Upstream: "grpc_backend"}), newData())
+		if !strings.Contains(out, "error_page 429 502 503 504 = @myapp_grpc_status_14;") {
+			t.Errorf("expected error_page to the unavailable status, got: %s", out)
+		}
+		if strings.Count(out, "location @myapp_grpc_status_14 {") != 1 {
+			t.Errorf("expected the grpc error locations once, got: %s", out)
+		}
+	})
+
+	t.Run("ErrorLocation", func(t *testing.T) {
+		out := buildGrpcErrorLocations("myapp", "add_header")
+		expected := "location @myapp_grpc_status_7 {\n  default_type application/grpc;\n  add_header grpc-status 7 always;\n  add_header grpc-message \"permission denied\" always;\n  return 204;\n}"
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q, got: %s", expected, out)
+		}
+	})
+
+	t.Run("NoHttp2Directive", func(t *testing.T) {
+		out := build(t, newConfig(&file_config.GrpcConfig{Upstream: "grpc_backend"}), newData())
+		if strings.Contains(out, "http2 on;") {
+			t.Errorf("expected HTTP/2 to be left to the listener, got: %s", out)
+		}
+	})
+
+	for name, upstream := range map[string]string{
+		"HttpProtocol": "web_backend",
+		"NoProtocol":   "plain_backend",
+		"ProcessType":  "web-5000",
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := buildErr(newConfig(&file_config.GrpcConfig{Upstream: upstream}), newData())
+			if err == nil || !strings.Contains(err.Error(), "protocol: grpc or grpcs") {
+				t.Errorf("expected a protocol error, got: %v", err)
+			}
+		})
+	}
+
+	t.Run("VhostWithoutHttp2", func(t *testing.T) {
+		cfg := newConfig(&file_config.GrpcConfig{Upstream: "grpc_backend"})
+		cfg.Vhosts[0].Http2 = false
+		if err := buildErr(cfg, newData()); err == nil || !strings.Contains(err.Error(), "http2") {
+			t.Errorf("expected an http2 error, got: %v", err)
+		}
+	})
+
+	t.Run("NginxWithoutHttp2", func(t *testing.T) {
+		data := newData()
+		data.http2Supported = false
+		if err := buildErr(newConfig(&file_config.GrpcConfig{Upstream: "grpc_backend"}), data); err == nil || !strings.Contains(err.Error(), "HTTP/2 support") {
+			t.Errorf("expected an HTTP/2 support error, got: %v", err)
+		}
+	})
+}
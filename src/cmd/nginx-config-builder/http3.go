@@ -0,0 +1,111 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+const http3DefaultAltSvcMaxAge = 86400
+
+var http3DefaultListen = []string{"443", "[::]:443"}
+
+var quicReuseportListenRegexp = regexp.MustCompile(`(?m)^\s*listen\s+(\S+)\s+[^;]*\bquic\b[^;]*\breuseport\b`)
+
+// quicReuseports maps QUIC listen addresses that already carry reuseport to the
+// config file or vhost owning them. nginx allows reuseport only once per
+// address:port.
+type quicReuseports map[string]string
+
+// quicListenKey normalizes a listen address so that `443`, `*:443` and
+// `0.0.0.0:443` are considered the same socket.
+func quicListenKey(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "*:" + addr
+	}
+	if host == "" || host == "*" || host == "0.0.0.0" {
+		return "*:" + port
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// otherAppsVhostConfigs lists the vhost configs of the current release of
+// every app but the one being built.
+func otherAppsVhostConfigs(appDataRootDirs []string, ownAppDataRootDir string, proxyName string) ([]string, error) {
+	files := make([]string, 0)
+	for _, dir := range appDataRootDirs {
+		if filepath.Clean(dir) == filepath.Clean(ownAppDataRootDir) {
+			continue
+		}
+		matches, err := filepath.Glob(path.Join(dir, fmt.Sprintf("%s-config", proxyName), "conf.d", "current", "vhosts", "*", "vhost.conf"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// scanQuicReuseports finds the QUIC listen addresses already using reuseport
+// in the given config files.
+func scanQuicReuseports(files []string) (quicReuseports, error) {
+	reuseports := make(quicReuseports)
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		for _, match := range quicReuseportListenRegexp.FindAllStringSubmatch(string(content), -1) {
+			reuseports[quicListenKey(match[1])] = file
+		}
+	}
+	return reuseports, nil
+}
+
+// buildHttp3Lines renders the QUIC listen directives of a vhost and its
+// Alt-Svc header. reuseport is added to the first listener of an address that
+// no other vhost or app has claimed yet.
+func buildHttp3Lines(serverName string, http3 *file_config.Http3Config, data *locationConfigData) ([]string, string, error) {
+	if !data.quicSupported {
+		return nil, "", fmt.Errorf("nginx was built without HTTP/3 (QUIC) support (--with-http_v3_module)")
+	}
+	if data.quicReuseports == nil {
+		data.quicReuseports = make(quicReuseports)
+	}
+
+	listen := http3.Listen
+	if len(listen) == 0 {
+		listen = http3DefaultListen
+	}
+
+	lines := make([]string, 0, len(listen)+1)
+	for _, addr := range listen {
+		key := quicListenKey(addr)
+		if owner, ok := data.quicReuseports[key]; ok {
+			log.Printf("[info] quic listener %s of %s does not use reuseport, already set by %s\n", addr, serverName, owner)
+			lines = append(lines, fmt.Sprintf("listen %s quic;", addr))
+			continue
+		}
+		data.quicReuseports[key] = serverName
+		lines = append(lines, fmt.Sprintf("listen %s quic reuseport;", addr))
+	}
+	lines = append(lines, "http3 on;")
+
+	_, port, err := net.SplitHostPort(listen[0])
+	if err != nil {
+		port = listen[0]
+	}
+	maxAge := http3.AltSvcMaxAge
+	if maxAge == 0 {
+		maxAge = http3DefaultAltSvcMaxAge
+	}
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=%d`, port, maxAge)
+
+	return lines, nginxAddHeader(data.addHeaderMode, "Alt-Svc", nginxHeaderValue(data.addHeaderMode, altSvc)), nil
+}
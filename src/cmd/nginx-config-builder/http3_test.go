@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_Http3(t *testing.T) {
+	cfg := &file_config.Config{
+		UserVars: file_config.ConfigVars{},
+		SysVars:  file_config.ConfigVars{},
+		Vhosts: []file_config.VhostConfig{
+			{
+				ServerName: "a.example.com",
+				Http3:      &file_config.Http3Config{},
+				Locations:  []file_config.LocationConfig{{Uri: "/", Body: "return 200;"}},
+			},
+			{
+				ServerName: "b.example.com",
+				Http3:      &file_config.Http3Config{Listen: []string{"0.0.0.0:443", "127.0.0.1:8443"}, AltSvcMaxAge: 3600},
+				Locations:  []file_config.LocationConfig{{Uri: "/", Body: "return 200;"}},
+			},
+		},
+	}
+
+	data := &locationConfigData{
+		addHeaderMode:  "add_header",
+		quicSupported:  true,
+		quicReuseports: quicReuseports{"[::]:443": "/other/vhost.conf"},
+	}
+	locationConfigs, _, err := buildLocationConfig("myapp", cfg, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for vhost, expectedLines := range map[string][]string{
+		"a.example.com": {
+			"listen 443 quic reuseport;",
+			"listen [::]:443 quic;",
+			"http3 on;",
+			`add_header Alt-Svc "h3=\":443\"; ma=86400" always;`,
+			"location / {\n  add_header Alt-Svc",
+		},
+		"b.example.com": {
+			"listen 0.0.0.0:443 quic;",
+			"listen 127.0.0.1:8443 quic reuseport;",
+			`add_header Alt-Svc "h3=\":443\"; ma=3600" always;`,
+		},
+	} {
+		for _, expected := range expectedLines {
+			if !strings.Contains(locationConfigs[vhost], expected) {
+				t.Fatalf("expected %q in %s output, got: %s", expected, vhost, locationConfigs[vhost])
+			}
+		}
+	}
+
+	data.addHeaderMode = "more_set_headers"
+	data.quicReuseports = quicReuseports{}
+	locationConfigs, _, err = buildLocationConfig("myapp", cfg, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// once at server level and once in the location
+	if expected := `more_set_headers "Alt-Svc: h3=\":443\"; ma=86400";`; strings.Count(locationConfigs["a.example.com"], expected) != 2 {
+		t.Fatalf("expected %q at server and location level, got: %s", expected, locationConfigs["a.example.com"])
+	}
+
+	data.quicSupported = false
+	if _, _, err := buildLocationConfig("myapp", cfg, data); err == nil || !strings.Contains(err.Error(), "QUIC") {
+		t.Fatalf("expected error without QUIC support, got: %v", err)
+	}
+}
+
+func TestScanQuicReuseports(t *testing.T) {
+	root := t.TempDir()
+	vhostDir := filepath.Join(root, "app-other", "nginx-custom-config", "conf.d", "current", "vhosts", "other.example.com")
+	if err := os.MkdirAll(vhostDir, 0755); err != nil {
+		t.Fatalf("failed to create vhost dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(vhostDir, "vhost.conf"), []byte("listen *:443 quic reuseport;\nlisten [::]:443 quic;\n"), 0644); err != nil {
+		t.Fatalf("failed to write vhost config: %v", err)
+	}
+
+	files, err := otherAppsVhostConfigs([]string{filepath.Join(root, "app-other"), filepath.Join(root, "app-myapp")}, filepath.Join(root, "app-myapp"), "nginx-custom")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reuseports, err := scanQuicReuseports(files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reuseports) != 1 || reuseports["*:443"] == "" {
+		t.Fatalf("unexpected reuseports: %v", reuseports)
+	}
+}
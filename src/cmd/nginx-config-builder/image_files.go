@@ -0,0 +1,45 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+)
+
+// imageFileReader reads a file from the app container filesystem. Relative
+// paths are resolved against the image working directory.
+type imageFileReader func(filePath string) ([]byte, error)
+
+// newDockerImageFileReader reads files with `docker cp`, which only requires
+// access to the docker daemon (unlike reading the overlay merged dir).
+func newDockerImageFileReader(containerID string, workingDir string) imageFileReader {
+	return func(filePath string) ([]byte, error) {
+		if containerID == "" {
+			return nil, fmt.Errorf("cannot read %q from image: app container is unknown", filePath)
+		}
+		if !path.IsAbs(filePath) {
+			filePath = path.Join("/", workingDir, filePath)
+		}
+
+		cmd := exec.Command("docker", "cp", "-L", fmt.Sprintf("%s:%s", containerID, filePath), "-")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %q from container: %w: %s", filePath, err, stderr.String())
+		}
+
+		tr := tar.NewReader(bytes.NewReader(output))
+		header, err := tr.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q from container archive: %w", filePath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%q in image is not a regular file", filePath)
+		}
+		return io.ReadAll(tr)
+	}
+}
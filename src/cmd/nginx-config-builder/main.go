@@ -1,7 +1,9 @@
 package main
 
 import (
+	dokkuproperty "dokku-nginx-custom/src/pkg/dokku_property"
 	"dokku-nginx-custom/src/pkg/file_config"
+	"dokku-nginx-custom/src/pkg/nginx_cache"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -628,12 +630,31 @@ type locationConfigData struct {
 	mapVariables  mapResultingVariables
 	proxyCaches   cacheResultingNames
 	fastcgiCaches cacheResultingNames
+
+	// releaseDir is the absolute release directory generated files are written to.
+	releaseDir    string
+	getProperty   func(appName string, property string) string
+	readImageFile imageFileReader
+	addHeaderMode string
+	// certsDir holds the certificate installed with the Dokku certs plugin.
+	certsDir string
+	// http2Supported tells whether nginx supports HTTP/2, which the server
+	// template then enables on the TLS listeners.
+	http2Supported bool
+	// quicSupported tells whether nginx was built with HTTP/3 support.
+	quicSupported bool
+	// quicReuseports is updated as vhosts claim reuseport on QUIC listeners.
+	quicReuseports quicReuseports
+
+	containerFilesystem containerFilesystem
 }
 
 type vhostToLocationConfigStringMap map[string]string
 
-func buildLocationConfig(appName string, config *file_config.Config, data *locationConfigData) (vhostToLocationConfigStringMap, error) {
+func buildLocationConfig(appName string, config *file_config.Config, data *locationConfigData) (vhostToLocationConfigStringMap, releaseFiles, error) {
 	locationConfigs := make(vhostToLocationConfigStringMap, 0)
+	files := make(releaseFiles, 0)
+	keepaliveNames := keepaliveUpstreams(appName, config, data.upstreams)
 
 	tmplLocationBlockStr := `{{- if or $.uri $.named -}}
 location {{ $.modifier }}{{ if $.named }}@{{ $.named }}{{ else }}{{ $.uri }}{{ end }} {
@@ -682,25 +703,193 @@ location {{ $.modifier }}{{ if $.named }}@{{ $.named }}{{ else }}{{ $.uri }}{{ e
 			"sys_vars":        config.SysVars,
 		}
 
-		for _, location := range vhost.Locations {
+		if vhost.AuthBasic != nil {
+			authLines, err := buildAuthBasicLines(appName, vhost.AuthBasic, fmt.Sprintf("vhosts/%s/auth_basic/server.htpasswd", vhost.ServerName), data, bodyTmplData, files)
+			if err != nil {
+				return nil, nil, fmt.Errorf("vhost %s: failed to build auth_basic: %w", vhost.ServerName, err)
+			}
+			locationConfigStr += strings.Join(authLines, "\n") + "\n\n"
+		}
+
+		if vhost.Access != nil {
+			accessLines, err := buildAccessLines(appName, vhost.Access, config, data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("vhost %s: invalid access: %w", vhost.ServerName, err)
+			}
+			locationConfigStr += strings.Join(accessLines, "\n") + "\n\n"
+		}
+
+		if vhost.Tls != nil {
+			tlsLines, err := buildTlsLines(vhost.ServerName, vhost.Tls, data.certsDir, time.Now())
+			if err != nil {
+				return nil, nil, fmt.Errorf("vhost %s: invalid tls: %w", vhost.ServerName, err)
+			}
+			locationConfigStr += strings.Join(tlsLines, "\n") + "\n\n"
+		}
+
+		redirectCfg, err := buildRedirectConfig(appName, vhost)
+		if err != nil {
+			return nil, nil, fmt.Errorf("vhost %s: invalid redirects: %w", vhost.ServerName, err)
+		}
+		locationConfigStr += redirectCfg
+
+		errorPagesCfg, err := buildErrorPagesConfig(appName, config, vhost, data, files)
+		if err != nil {
+			return nil, nil, fmt.Errorf("vhost %s: invalid error_pages: %w", vhost.ServerName, err)
+		}
+		locationConfigStr += errorPagesCfg
+
+		// Server-level response headers, repeated in locations since any
+		// add_header there drops the inherited ones.
+		headerLines := make([]string, 0)
+		if vhost.SecurityHeaders != nil {
+			lines, err := buildSecurityHeadersLines(vhost.SecurityHeaders, data.addHeaderMode)
+			if err != nil {
+				return nil, nil, fmt.Errorf("vhost %s: invalid security_headers: %w", vhost.ServerName, err)
+			}
+			headerLines = append(headerLines, lines...)
+		}
+
+		if vhost.Http2 && !data.http2Supported {
+			return nil, nil, fmt.Errorf("vhost %s: http2 requires nginx with HTTP/2 support", vhost.ServerName)
+		}
+
+		if vhost.Http3 != nil {
+			http3Lines, altSvcLine, err := buildHttp3Lines(vhost.ServerName, vhost.Http3, data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("vhost %s: invalid http3: %w", vhost.ServerName, err)
+			}
+			locationConfigStr += strings.Join(http3Lines, "\n") + "\n\n"
+			headerLines = append(headerLines, altSvcLine)
+		}
+
+		if len(headerLines) > 0 {
+			locationConfigStr += strings.Join(headerLines, "\n") + "\n\n"
+		}
+
+		authLocations := newAuthRequestLocations(appName)
+		internalLocations := make([]string, 0)
+		grpcErrorLocationsAdded := false
+
+		for locationIndex, location := range vhost.Locations {
 
 			modifierOut, err := sigil.Execute([]byte(location.Modifier), bodyTmplData, fmt.Sprintf("location_modifier_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse location.Modifier template: %w", err)
+				return nil, nil, fmt.Errorf("failed to parse location.Modifier template: %w", err)
 			}
 			tmplData["modifier"] = modifierOut.String()
 
 			uriOut, err := sigil.Execute([]byte(location.Uri), bodyTmplData, fmt.Sprintf("location_uri_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse location.Uri template: %w", err)
+				return nil, nil, fmt.Errorf("failed to parse location.Uri template: %w", err)
 			}
 			tmplData["uri"] = uriOut.String()
 
 			bodyOut, err := sigil.Execute([]byte(location.Body), bodyTmplData, fmt.Sprintf("location_body_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse location.Body template: %w", err)
+				return nil, nil, fmt.Errorf("failed to parse location.Body template: %w", err)
 			}
 			bodyLines := strings.Split(bodyOut.String(), "\n")
+			if location.Body == "" {
+				bodyLines = nil
+			}
+
+			if location.Websocket {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: websocket requires uri or named", vhost.ServerName, locationIndex)
+				}
+				websocketLines, err := buildWebsocketLines(appName, location, bodyOut.String())
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(websocketLines, bodyLines...)
+			} else {
+				warnKeepaliveWithoutWebsocket(vhost.ServerName, locationIndex, bodyOut.String(), keepaliveNames)
+			}
+
+			if location.Mirror != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: mirror requires uri or named", vhost.ServerName, locationIndex)
+				}
+				mirrorLines, mirrorLocation, err := buildMirrorLines(appName, vhost.ServerName, locationIndex, location.Mirror, data.upstreams)
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(mirrorLines, bodyLines...)
+				internalLocations = append(internalLocations, mirrorLocation)
+			}
+
+			if location.Static != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: static requires uri or named", vhost.ServerName, locationIndex)
+				}
+				staticLines, fallback, err := buildStaticLines(appName, vhost, locationIndex, data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(staticLines, bodyLines...)
+				internalLocations = append(internalLocations, fallback)
+			}
+
+			if location.Grpc != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: grpc requires uri or named", vhost.ServerName, locationIndex)
+				}
+				grpcLines, err := buildGrpcLines(appName, config, vhost, location.Grpc, data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(grpcLines, bodyLines...)
+				if !grpcErrorLocationsAdded {
+					internalLocations = append(internalLocations, buildGrpcErrorLocations(appName, data.addHeaderMode))
+					grpcErrorLocationsAdded = true
+				}
+			}
+
+			if location.AuthBasic != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: auth_basic requires uri or named", vhost.ServerName, locationIndex)
+				}
+				authLines, err := buildAuthBasicLines(appName, location.AuthBasic, fmt.Sprintf("vhosts/%s/auth_basic/location-%d.htpasswd", vhost.ServerName, locationIndex), data, bodyTmplData, files)
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: failed to build auth_basic: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(authLines, bodyLines...)
+			}
+
+			if location.AuthRequest != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: auth_request requires uri or named", vhost.ServerName, locationIndex)
+				}
+				authLines, err := buildAuthRequestLines(appName, location, bodyOut.String(), data.upstreams, authLocations)
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(authLines, bodyLines...)
+			}
+
+			if location.Access != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: access requires uri or named", vhost.ServerName, locationIndex)
+				}
+				accessLines, err := buildAccessLines(appName, location.Access, config, data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: invalid access: %w", vhost.ServerName, locationIndex, err)
+				}
+				bodyLines = append(accessLines, bodyLines...)
+			}
+
+			if len(headerLines) > 0 && (location.Uri != "" || location.Named != "") {
+				bodyLines = append(slices.Clone(headerLines), bodyLines...)
+			}
+
+			if cors := effectiveCors(vhost, location); cors != nil {
+				if location.Uri == "" && location.Named == "" {
+					return nil, nil, fmt.Errorf("vhost %s: location #%d: cors requires uri or named", vhost.ServerName, locationIndex)
+				}
+				corsLines := buildCorsLines(cors, corsOriginVariable(appName, vhost, locationIndex), data.addHeaderMode)
+				bodyLines = append(corsLines, bodyLines...)
+			}
 			tmplData["bodyLines"] = bodyLines
 
 			if location.Named != "" {
@@ -711,7 +900,7 @@ location {{ $.modifier }}{{ if $.named }}@{{ $.named }}{{ else }}{{ $.uri }}{{ e
 
 			locationOut, err := sigil.Execute([]byte(tmplLocationBlockStr), tmplData, fmt.Sprintf("location_block_vhost_%s_uri_%s", vhost.ServerName, location.Uri))
 			if err != nil {
-				return nil, fmt.Errorf("failed to parse tmplLocationBlockStr template: %w", err)
+				return nil, nil, fmt.Errorf("failed to parse tmplLocationBlockStr template: %w", err)
 			}
 
 			if locationConfigStr != "" {
@@ -721,10 +910,17 @@ location {{ $.modifier }}{{ if $.named }}@{{ $.named }}{{ else }}{{ $.uri }}{{ e
 
 		}
 
+		internalLocations = append(internalLocations, authLocations.String())
+		for _, internalLocation := range internalLocations {
+			if internalLocation != "" {
+				locationConfigStr += "\n" + internalLocation
+			}
+		}
+
 		locationConfigs[vhost.ServerName] = locationConfigStr
 	}
 
-	return locationConfigs, nil
+	return locationConfigs, files, nil
 }
 
 var nginxWorkingDirectory string
@@ -939,6 +1135,32 @@ func prettyJSON(v any) string {
 	return string(pretty)
 }
 
+// nginxAddHeader renders a response header directive according to NGINX_ADD_HEADER_MODE.
+// more_set_headers quotes the whole argument, escaping the value.
+func nginxAddHeader(addHeaderMode string, header string, value string) string {
+	if addHeaderMode == "more_set_headers" {
+		return fmt.Sprintf("more_set_headers %s;", nginxQuote(header+": "+value))
+	}
+	return fmt.Sprintf("add_header %s %s always;", header, value)
+}
+
+// nginxHeaderValue quotes a header value containing whitespace or nginx syntax
+// characters so it can be passed to nginxAddHeader. more_set_headers already
+// quotes the whole argument.
+func nginxHeaderValue(addHeaderMode string, value string) string {
+	if addHeaderMode == "more_set_headers" || !strings.ContainsAny(value, " \t;{}'\"\\") {
+		return value
+	}
+	return nginxQuote(value)
+}
+
+// nginxQuote double-quotes a string for an nginx config. Only backslashes and
+// double quotes are escaped, unlike %q which emits Go escapes such as \t and
+// \u00e9 that nginx doesn't understand.
+func nginxQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
 func normalizePath(path string) string {
 	return filepath.Clean(path)
 }
@@ -966,6 +1188,20 @@ func main() {
 	var umaskStr string
 	flag.StringVar(&umaskStr, "umask", "0022", "umask (e.g. 0022)")
 
+	var maintenanceMode string
+	flag.StringVar(&maintenanceMode, "maintenance", "", "turn maintenance mode on or off instead of building the config")
+	var maintenanceAllow string
+	flag.StringVar(&maintenanceAllow, "maintenance-allow", "", "comma separated IPs/CIDRs bypassing maintenance mode")
+	var maintenanceRetryAfter int
+	flag.IntVar(&maintenanceRetryAfter, "maintenance-retry-after", maintenanceDefaultRetryAfter, "Retry-After seconds sent in maintenance mode")
+	var maintenancePage string
+	flag.StringVar(&maintenancePage, "maintenance-page", "", "maintenance page path in the app image")
+	var maintenancePageTemplate string
+	flag.StringVar(&maintenancePageTemplate, "maintenance-page-template", "", "default maintenance page template, used when -maintenance-page is not set or cannot be read")
+
+	var warmCaches bool
+	flag.BoolVar(&warmCaches, "warm-caches", false, "request the warm_on_deploy pages of every cache instead of building the config")
+
 	flag.Parse()
 
 	modeVal, err := strconv.ParseUint(configFileModeStr, 8, 32)
@@ -994,6 +1230,63 @@ func main() {
 		}
 	}
 
+	if maintenanceMode != "" {
+		nginxConfigDirectory := path.Join(dokkuAppDataRootDirectory, fmt.Sprintf("%s-config", envMustNonEmpty("PROXY_NAME")), "conf.d")
+
+		var page []byte
+		if maintenanceMode == "on" {
+			if maintenancePage != "" {
+				readImageFile := newDockerImageFileReader(os.Getenv("DOKKU_APP_CONTAINER_ID"), os.Getenv("DOKKU_APP_CONTAINER_WORKING_DIR"))
+				if page, err = readImageFile(maintenancePage); err != nil {
+					log.Printf("[warn] failed to read maintenance page, using the default one: %v\n", err)
+				}
+			}
+			if page == nil {
+				if page, err = renderMaintenancePage(maintenancePageTemplate, appName, maintenanceRetryAfter); err != nil {
+					log.Fatalln("failed to build maintenance page:", err)
+				}
+			}
+		}
+
+		addHeaderMode := os.Getenv("NGINX_ADD_HEADER_MODE")
+		if addHeaderMode == "" {
+			addHeaderMode = "add_header"
+		}
+		opts := maintenanceOptions{
+			mode:           maintenanceMode,
+			allow:          parseMaintenanceAllow(maintenanceAllow),
+			retryAfter:     maintenanceRetryAfter,
+			page:           page,
+			addHeaderMode:  addHeaderMode,
+			configFileMode: configFileMode,
+			owner:          chown{uid: configFileOwnerUid, gid: configFileOwnerGid},
+		}
+		if !withoutNginxTest {
+			opts.nginxTestCommand = nginxTestCommandSplit
+		}
+		if err := runMaintenance(appName, nginxConfigDirectory, opts); err != nil {
+			log.Fatalln("failed to switch maintenance mode:", err)
+		}
+		log.Printf("maintenance mode turned %s\n", maintenanceMode)
+		return
+	}
+
+	if warmCaches {
+		cfg, _, err := file_config.ReadConfig(configFilePath)
+		if err != nil {
+			log.Fatalln("error parsing config file:", err)
+		}
+		readImageFile := newDockerImageFileReader(os.Getenv("DOKKU_APP_CONTAINER_ID"), os.Getenv("DOKKU_APP_CONTAINER_WORKING_DIR"))
+		failed, err := runCacheWarm(cfg, readImageFile)
+		if err != nil {
+			log.Fatalln("failed to warm caches:", err)
+		}
+		if failed > 0 {
+			log.Printf("[warn] %d cache warm-up requests failed\n", failed)
+		}
+		return
+	}
+
 	mustEnvs(
 		"PROXY_NAME",
 		"DOKKU_APP_CONTAINER_LABELS",
@@ -1013,7 +1306,8 @@ func main() {
 		"NGINX_ERROR_LOG_ROOT_DIR",
 	)
 
-	nginxWorkingDirectory = path.Join(dokkuAppDataRootDirectory, fmt.Sprintf("%s-config", envMustNonEmpty("PROXY_NAME")))
+	proxyName := envMustNonEmpty("PROXY_NAME")
+	nginxWorkingDirectory = path.Join(dokkuAppDataRootDirectory, fmt.Sprintf("%s-config", proxyName))
 	nginxConfigDirectory := path.Join(nginxWorkingDirectory, "conf.d")
 
 	cfg, _, readConfigFileErr := file_config.ReadConfig(configFilePath)
@@ -1047,10 +1341,20 @@ func main() {
 		containerMountsMap[mount.Destination] = mount
 	}
 
+	containerFs := containerFilesystem{
+		mounts:     make(map[string]string),
+		mergedDir:  os.Getenv("DOKKU_APP_CONTAINER_MERGED_DIR"),
+		workingDir: os.Getenv("DOKKU_APP_CONTAINER_WORKING_DIR"),
+	}
+	for destination, mount := range containerMountsMap {
+		containerFs.mounts[normalizePath(destination)] = mount.Source
+	}
+
 	cfg.SysVars = file_config.ConfigVars{
-		"container_labels": containerLabels,
-		"container_mounts": containerMountsMap,
-		"app_name":         appName,
+		"container_labels":      containerLabels,
+		"container_mounts":      containerMountsMap,
+		"container_working_dir": path.Join(containerFs.mergedDir, containerFs.workingDir),
+		"app_name":              appName,
 	}
 	fmt.Printf("[VARDEBUG] SysVars=%s\n", prettyJSON(cfg.SysVars))
 
@@ -1072,10 +1376,7 @@ func main() {
 
 	tmplFuncs := map[string]any{
 		"nginx_add_header": func(header string, value string) string {
-			if addHeaderMode == "add_header" {
-				return fmt.Sprintf("add_header %s %s always;", header, value)
-			}
-			return fmt.Sprintf("more_set_headers \"%s: %s\";", header, value)
+			return nginxAddHeader(addHeaderMode, header, value)
 		},
 		"nginx_log": func(params ...string) string {
 			if len(params) < 1 {
@@ -1146,9 +1447,14 @@ func main() {
 		log.Fatalln("error unmarshaling app listeners:", appListenersUnmarshalErr)
 	}
 	fmt.Printf("[VARDEBUG] appListeners computed=%s\n", prettyJSON(appListeners))
+	// every process type of the app is listed, even when scaled to zero
+	processTypes := make([]string, 0, len(appListeners))
+	for processType := range appListeners {
+		processTypes = append(processTypes, processType)
+	}
 	webListeners, ok := appListeners["web"]
 	if ok && len(webListeners) > 0 && webListeners[0] == "invalid" {
-		fmt.Printf("[VARDEBUG] invalid IP received, app listeners are empty")
+		log.Println("[warn] invalid IP received, app listeners are empty")
 		appListeners = map[string][]string{}
 	}
 	filteredAppListeners := make(map[string][]string)
@@ -1170,10 +1476,15 @@ func main() {
 	if err != nil {
 		log.Fatalln("failed to build upstream config:", err)
 	}
-	_ = upstreamCfgStr
+	upstreamCfgStr += addPlaceholderUpstreams(appName, cfg, processTypes, &tmplData, upstreams, path.Join(nginxWorkingDirectory, fmt.Sprintf("%s-placeholder.sock", appName)))
 	fmt.Printf("[VARDEBUG] upstreams=%s\n", prettyJSON(upstreams))
 	fmt.Printf("[VARDEBUG] upstreamCfgStr=%s\n", upstreamCfgStr)
 
+	streamCfgStr, err := buildStreamConfig(appName, cfg, &tmplData)
+	if err != nil {
+		log.Fatalln("failed to build stream config:", err)
+	}
+
 	proxyCacheDefaultFlags := make(map[string]string)
 	for _, flag := range strings.Split(os.Getenv("PROXY_CACHE_DEFAULT_FLAGS"), " ") {
 		flagSplit := strings.Split(flag, "=")
@@ -1228,27 +1539,99 @@ func main() {
 	if err != nil {
 		log.Fatalln("failed to build map config:", err)
 	}
+
+	readImageFile := newDockerImageFileReader(os.Getenv("DOKKU_APP_CONTAINER_ID"), os.Getenv("DOKKU_APP_CONTAINER_WORKING_DIR"))
+
+	if err := loadRedirectsFiles(cfg, readImageFile); err != nil {
+		log.Fatalln("failed to load redirects:", err)
+	}
+
+	redirectMapCfgStr, err := buildRedirectMapConfig(appName, cfg)
+	if err != nil {
+		log.Fatalln("failed to build redirect map config:", err)
+	}
+	mapCfgStr += redirectMapCfgStr
+
+	staticMapCfgStr, err := buildStaticMapConfig(appName, cfg)
+	if err != nil {
+		log.Fatalln("failed to build static map config:", err)
+	}
+	mapCfgStr += staticMapCfgStr
+
+	corsMapCfgStr, err := buildCorsMapConfig(appName, cfg)
+	if err != nil {
+		log.Fatalln("failed to build cors map config:", err)
+	}
+	mapCfgStr += corsMapCfgStr
+	mapCfgStr += buildWebsocketMapConfig(appName, cfg)
+	mapCfgStr += buildMirrorMapConfig(appName, cfg)
 	fmt.Printf("[VARDEBUG] mapCfgStr=%s\n", mapCfgStr)
 	fmt.Printf("[VARDEBUG] mapResultingVariables=%s\n", prettyJSON(mapResultingVariables))
 
-	locationConfigs, err := buildLocationConfig(appName, cfg, &locationConfigData{
+	latestReleaseDir, err := getCurrentConfigVersionDirectory(nginxConfigDirectory)
+	if err != nil {
+		log.Fatalln("failed to get latest release directory:", err)
+	}
+
+	// In maintenance mode, build the release maintenance was turned on from and
+	// refresh the maintenance copy afterwards.
+	maintenance, err := readMaintenanceState(latestReleaseDir)
+	if err != nil {
+		log.Fatalln("failed to read maintenance state:", err)
+	}
+	maintenanceDir := ""
+	if maintenance != nil {
+		log.Printf("[info] app is in maintenance mode, building %s and keeping maintenance on\n", maintenance.PreviousRelease)
+		maintenanceDir = latestReleaseDir
+		latestReleaseDir = maintenance.PreviousRelease
+	}
+
+	otherVhostConfigs, err := otherAppsVhostConfigs(strings.Fields(os.Getenv("DOKKU_APPS_DATA_ROOT_DIRS")), dokkuAppDataRootDirectory, proxyName)
+	if err != nil {
+		log.Fatalln("failed to list vhost configs of other apps:", err)
+	}
+	reuseports, err := scanQuicReuseports(otherVhostConfigs)
+	if err != nil {
+		log.Fatalln("failed to scan quic listeners of other apps:", err)
+	}
+
+	locationConfigs, locationFiles, err := buildLocationConfig(appName, cfg, &locationConfigData{
 		upstreams:     upstreams,
 		proxyCaches:   proxyCaches,
 		fastcgiCaches: fastcgiCaches,
 		mapVariables:  mapResultingVariables,
+		releaseDir:    latestReleaseDir,
+		getProperty:   dokkuproperty.GetComputedProperty,
+		readImageFile: readImageFile,
+		addHeaderMode: addHeaderMode,
+		certsDir:      os.Getenv("DOKKU_APP_SSL_PATH"),
+
+		http2Supported: os.Getenv("HTTP2_SUPPORTED") == "true",
+		quicSupported:  os.Getenv("NGINX_QUIC_SUPPORTED") == "true",
+		quicReuseports: reuseports,
+
+		containerFilesystem: containerFs,
 	})
 	if err != nil {
 		log.Fatalln("failed to build location config:", err)
 	}
 
-	latestReleaseDir, err := getCurrentConfigVersionDirectory(nginxConfigDirectory)
+	_, err = getPreviousVersionDirectory(nginxConfigDirectory)
 	if err != nil {
-		log.Fatalln("failed to get latest release directory:", err)
+		log.Fatalln("failed to get previous version directory:", err)
 	}
 
-	_, err = getPreviousVersionDirectory(nginxConfigDirectory)
+	cacheManifest, err := buildCacheManifest(
+		map[string]string{"proxy": proxyCacheCfgStr, "fastcgi": fastcgiCacheCfgStr},
+		map[string]cacheResultingNames{"proxy": proxyCaches, "fastcgi": fastcgiCaches},
+		locationConfigs,
+	)
 	if err != nil {
-		log.Fatalln("failed to get previous version directory:", err)
+		log.Fatalln("failed to fingerprint caches:", err)
+	}
+	cacheManifestContent, err := json.MarshalIndent(cacheManifest, "", "  ")
+	if err != nil {
+		log.Fatalln("failed to encode cache manifest:", err)
 	}
 
 	configFiles := map[string]string{
@@ -1256,27 +1639,53 @@ func main() {
 		"proxy_caches.conf":   proxyCacheCfgStr,
 		"fastcgi_caches.conf": fastcgiCacheCfgStr,
 		"maps.conf":           mapCfgStr,
+		"streams.conf":        streamCfgStr,
 	}
+	configFiles[nginx_cache.ManifestFile] = string(cacheManifestContent)
 
 	for vhost, locationConfig := range locationConfigs {
 		configFiles[fmt.Sprintf("vhosts/%s/vhost.conf", vhost)] = locationConfig
 		fmt.Printf("[VARDEBUG] location config for vhost %s: %s\n", vhost, locationConfig)
 	}
 
+	for filename, content := range locationFiles {
+		configFiles[filename] = content
+	}
+
 	for filename, content := range configFiles {
 		if err := copyConfigToRelease(content, latestReleaseDir, filename, configFileMode, chown{uid: configFileOwnerUid, gid: configFileOwnerGid}); err != nil {
 			log.Fatalln("failed to copy config file:", err)
 		}
 	}
 
-	if err := updateCurrentSymlink(nginxConfigDirectory, latestReleaseDir); err != nil {
-		log.Fatalln("failed to update current symlink:", err)
-	}
+	if maintenance != nil {
+		page, err := os.ReadFile(path.Join(maintenanceDir, maintenancePageFile))
+		if err != nil {
+			log.Fatalln("failed to read maintenance page:", err)
+		}
+		opts := maintenanceOptions{
+			page:           page,
+			addHeaderMode:  addHeaderMode,
+			configFileMode: configFileMode,
+			owner:          chown{uid: configFileOwnerUid, gid: configFileOwnerGid},
+		}
+		if !withoutNginxTest {
+			log.Printf("performing nginx test with commands: %#v\n", nginxTestCommandSplit)
+			opts.nginxTestCommand = nginxTestCommandSplit
+		}
+		if err := replaceMaintenanceRelease(appName, nginxConfigDirectory, maintenanceDir, maintenance, opts); err != nil {
+			log.Fatalln("failed to refresh maintenance release:", err)
+		}
+	} else {
+		if err := updateCurrentSymlink(nginxConfigDirectory, latestReleaseDir); err != nil {
+			log.Fatalln("failed to update current symlink:", err)
+		}
 
-	if !withoutNginxTest {
-		log.Printf("performing nginx test with commands: %#v\n", nginxTestCommandSplit)
-		if err := testNginxConfig(nginxTestCommandSplit...); err != nil {
-			log.Fatalf("nginx config test failed: %v\n", err)
+		if !withoutNginxTest {
+			log.Printf("performing nginx test with commands: %#v\n", nginxTestCommandSplit)
+			if err := testNginxConfig(nginxTestCommandSplit...); err != nil {
+				log.Fatalf("nginx config test failed: %v\n", err)
+			}
 		}
 	}
 	log.Println("nginx configuration deployed successfully")
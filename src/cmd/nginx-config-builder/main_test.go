@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -414,3 +415,25 @@ func TestGetCurrentConfigVersionDirectoryNewRelease(t *testing.T) {
 		}
 	})
 }
+
+// nginxBlock returns the block opened by header in config, braces included,
+// or "" if there is none.
+func nginxBlock(config string, header string) string {
+	start := strings.Index(config, header+" {\n")
+	if start < 0 {
+		return ""
+	}
+	depth := 0
+	for i := start + len(header); i < len(config); i++ {
+		switch config[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return config[start : i+1]
+			}
+		}
+	}
+	return config[start:]
+}
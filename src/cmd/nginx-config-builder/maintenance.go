@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/sigil"
+)
+
+const maintenanceStateFile = "maintenance.json"
+const maintenancePageFile = "maintenance/maintenance.html"
+const maintenanceDefaultRetryAfter = 300
+
+var vhostConfigPathRegexp = regexp.MustCompile(`^vhosts/[^/]+/vhost\.conf$`)
+
+// maintenanceState is stored in a maintenance release. The release is a copy
+// of PreviousRelease with every vhost answering 503, so turning maintenance off
+// only points current back to PreviousRelease.
+type maintenanceState struct {
+	PreviousRelease string   `json:"previous_release"`
+	Allow           []string `json:"allow"`
+	RetryAfter      int      `json:"retry_after"`
+}
+
+// readMaintenanceState returns the maintenance state of a release, or nil if
+// it is a regular release.
+func readMaintenanceState(releaseDir string) (*maintenanceState, error) {
+	content, err := os.ReadFile(path.Join(releaseDir, maintenanceStateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance state: %w", err)
+	}
+	state := &maintenanceState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("failed to parse maintenance state: %w", err)
+	}
+	return state, nil
+}
+
+// nextReleaseDirectory returns a new release directory, sorting after every
+// existing one.
+func nextReleaseDirectory(nginxConfigDirectory string, now time.Time) (string, error) {
+	files, err := filepath.Glob(path.Join(nginxConfigDirectory, "release-*"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read nginx config directory: %w", err)
+	}
+	prefix := fmt.Sprintf("release-%s.", now.Format("20060102"))
+	sequence := 1
+	for _, file := range files {
+		name := filepath.Base(file)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, prefix)); err == nil && n >= sequence {
+			sequence = n + 1
+		}
+	}
+	return path.Join(nginxConfigDirectory, fmt.Sprintf("%s%d", prefix, sequence)), nil
+}
+
+func parseMaintenanceAllow(raw string) []string {
+	allow := make([]string, 0)
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			allow = append(allow, entry)
+		}
+	}
+	return allow
+}
+
+func maintenanceVariable(appName string) string {
+	return nginxVariableName(appName, "maintenance")
+}
+
+// buildMaintenanceGeoConfig renders the geo block telling whether a client is
+// held back by maintenance.
+func buildMaintenanceGeoConfig(appName string, allow []string) (string, error) {
+	cfgStr := fmt.Sprintf("geo $%s {\n  default 1;\n", maintenanceVariable(appName))
+	for _, entry := range allow {
+		if err := validateAccessAddress(entry); err != nil {
+			return "", err
+		}
+		cfgStr += fmt.Sprintf("  %s 0;\n", entry)
+	}
+	return cfgStr + "}\n", nil
+}
+
+// buildMaintenanceServerConfig renders the server-level lines answering 503.
+// The rewrite happens before location matching so it applies to every location,
+// and the page is served from a named location, which skips it.
+func buildMaintenanceServerConfig(appName string, releaseDir string, retryAfter int, addHeaderMode string) string {
+	return fmt.Sprintf(`# maintenance mode
+error_page 503 @%[1]s_maintenance;
+if ($%[2]s) {
+  return 503;
+}
+
+location @%[1]s_maintenance {
+  root %[3]s;
+  default_type text/html;
+  %[4]s
+  try_files /%[5]s =503;
+}
+
+`, appName, maintenanceVariable(appName), releaseDir, nginxAddHeader(addHeaderMode, "Retry-After", strconv.Itoa(retryAfter)), maintenancePageFile)
+}
+
+// renderMaintenancePage renders the default maintenance page template.
+func renderMaintenancePage(templatePath string, appName string, retryAfter int) ([]byte, error) {
+	content, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance page template: %w", err)
+	}
+	out, err := sigil.Execute(content, map[string]any{"app_name": appName, "retry_after": retryAfter}, "maintenance_page")
+	if err != nil {
+		return nil, fmt.Errorf("failed to render maintenance page template: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// writeMaintenanceRelease creates dir as a copy of state.PreviousRelease where
+// every vhost answers 503. The config refers to the release as maintenanceDir,
+// where dir is moved once tested.
+func writeMaintenanceRelease(appName string, dir string, maintenanceDir string, state *maintenanceState, page []byte, addHeaderMode string, configFileMode fs.FileMode, owner chown) error {
+	geoCfg, err := buildMaintenanceGeoConfig(appName, state.Allow)
+	if err != nil {
+		return err
+	}
+	serverCfg := buildMaintenanceServerConfig(appName, maintenanceDir, state.RetryAfter, addHeaderMode)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clear maintenance release: %w", err)
+	}
+
+	files := make(map[string]string)
+	err = filepath.WalkDir(state.PreviousRelease, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(state.PreviousRelease, p)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read release %s: %w", state.PreviousRelease, err)
+	}
+
+	files["maps.conf"] += geoCfg
+	for filename, content := range files {
+		if vhostConfigPathRegexp.MatchString(filename) {
+			files[filename] = serverCfg + content
+		}
+	}
+	files[maintenancePageFile] = string(page)
+	stateContent, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	files[maintenanceStateFile] = string(stateContent)
+
+	for filename, content := range files {
+		if err := copyConfigToRelease(content, dir, filename, configFileMode, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceMaintenanceRelease writes the maintenance release to a temporary
+// directory, points current at it for the nginx test, and only then moves it
+// to maintenanceDir. On failure the temporary directory is deleted, and
+// current and any existing maintenanceDir are left as they were.
+func replaceMaintenanceRelease(appName string, nginxConfigDirectory string, maintenanceDir string, state *maintenanceState, opts maintenanceOptions) error {
+	previous, err := getPreviousVersionDirectory(nginxConfigDirectory)
+	if err != nil {
+		return err
+	}
+	// not a release name, so never picked as the latest release
+	tmpDir := maintenanceDir + ".tmp"
+	fail := func(err error) error {
+		if previous != "" {
+			if restoreErr := updateCurrentSymlink(nginxConfigDirectory, previous); restoreErr != nil {
+				err = fmt.Errorf("%w (and failed to restore previous release: %v)", err, restoreErr)
+			}
+		}
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	if err := writeMaintenanceRelease(appName, tmpDir, maintenanceDir, state, opts.page, opts.addHeaderMode, opts.configFileMode, opts.owner); err != nil {
+		return fail(err)
+	}
+	if len(opts.nginxTestCommand) > 0 {
+		if err := updateCurrentSymlink(nginxConfigDirectory, tmpDir); err != nil {
+			return fail(err)
+		}
+		if err := testNginxConfig(opts.nginxTestCommand...); err != nil {
+			return fail(err)
+		}
+	}
+
+	oldDir := ""
+	if _, err := os.Stat(maintenanceDir); err == nil {
+		oldDir = maintenanceDir + ".old"
+		if err := os.RemoveAll(oldDir); err != nil {
+			return fail(fmt.Errorf("failed to clear previous maintenance release: %w", err))
+		}
+		if err := os.Rename(maintenanceDir, oldDir); err != nil {
+			return fail(fmt.Errorf("failed to move previous maintenance release: %w", err))
+		}
+	}
+	if err := os.Rename(tmpDir, maintenanceDir); err != nil {
+		if oldDir != "" {
+			os.Rename(oldDir, maintenanceDir)
+		}
+		return fail(fmt.Errorf("failed to move maintenance release into place: %w", err))
+	}
+	if err := updateCurrentSymlink(nginxConfigDirectory, maintenanceDir); err != nil {
+		return err
+	}
+	if oldDir != "" {
+		if err := os.RemoveAll(oldDir); err != nil {
+			return fmt.Errorf("failed to remove previous maintenance release: %w", err)
+		}
+	}
+	return nil
+}
+
+type maintenanceOptions struct {
+	mode             string
+	allow            []string
+	retryAfter       int
+	page             []byte
+	addHeaderMode    string
+	configFileMode   fs.FileMode
+	owner            chown
+	nginxTestCommand []string
+}
+
+// runMaintenance turns maintenance on or off for the current release. It does
+// not render the app config, so it works without listeners. Either way, the
+// release switched to is tested before the one it replaces is removed.
+func runMaintenance(appName string, nginxConfigDirectory string, opts maintenanceOptions) error {
+	current, err := getPreviousVersionDirectory(nginxConfigDirectory)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return fmt.Errorf("app %s has no release yet", appName)
+	}
+	state, err := readMaintenanceState(current)
+	if err != nil {
+		return err
+	}
+
+	switch opts.mode {
+	case "on":
+		maintenanceDir := current
+		if state == nil {
+			maintenanceDir, err = nextReleaseDirectory(nginxConfigDirectory, time.Now())
+			if err != nil {
+				return err
+			}
+			state = &maintenanceState{PreviousRelease: current}
+		}
+		state.Allow = opts.allow
+		state.RetryAfter = opts.retryAfter
+		return replaceMaintenanceRelease(appName, nginxConfigDirectory, maintenanceDir, state, opts)
+
+	case "off":
+		if state == nil {
+			return fmt.Errorf("app %s is not in maintenance mode", appName)
+		}
+		if err := updateCurrentSymlink(nginxConfigDirectory, state.PreviousRelease); err != nil {
+			return err
+		}
+		if len(opts.nginxTestCommand) > 0 {
+			if err := testNginxConfig(opts.nginxTestCommand...); err != nil {
+				if restoreErr := updateCurrentSymlink(nginxConfigDirectory, current); restoreErr != nil {
+					err = fmt.Errorf("%w (and failed to restore maintenance release: %v)", err, restoreErr)
+				}
+				return err
+			}
+		}
+		if err := os.RemoveAll(current); err != nil {
+			return fmt.Errorf("failed to remove maintenance release: %w", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid maintenance mode %q, expected on or off", opts.mode)
+}
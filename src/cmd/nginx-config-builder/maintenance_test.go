@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newMaintenanceTestRelease creates a release made current in a new config
+// directory, and the options turning maintenance on for it.
+func newMaintenanceTestRelease(t *testing.T) (string, string, maintenanceOptions) {
+	t.Helper()
+	configDir := t.TempDir()
+	releaseDir := filepath.Join(configDir, "release-20240101.1")
+	owner := chown{uid: os.Getuid(), gid: os.Getgid()}
+	for filename, content := range map[string]string{
+		"maps.conf":                     "map $host $myapp_x {\n}\n",
+		"upstreams.conf":                "upstream myapp-web-5000 {\n}\n",
+		"vhosts/example.com/vhost.conf": "location / {\n  proxy_pass http://myapp-web-5000;\n}\n",
+	} {
+		if err := copyConfigToRelease(content, releaseDir, filename, 0644, owner); err != nil {
+			t.Fatalf("failed to write release: %v", err)
+		}
+	}
+	if err := updateCurrentSymlink(configDir, releaseDir); err != nil {
+		t.Fatalf("failed to create current symlink: %v", err)
+	}
+
+	return configDir, releaseDir, maintenanceOptions{
+		mode:           "on",
+		allow:          parseMaintenanceAllow("10.0.0.0/8, 192.0.2.1"),
+		retryAfter:     120,
+		page:           []byte("<h1>maintenance</h1>"),
+		addHeaderMode:  "add_header",
+		configFileMode: 0644,
+		owner:          owner,
+	}
+}
+
+func readMaintenanceTestFile(t *testing.T, dir string, filename string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", filename, err)
+	}
+	return string(content)
+}
+
+func TestRunMaintenance(t *testing.T) {
+	configDir, releaseDir, opts := newMaintenanceTestRelease(t)
+	if err := runMaintenance("myapp", configDir, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current, err := getPreviousVersionDirectory(configDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vhost := readMaintenanceTestFile(t, current, "vhosts/example.com/vhost.conf")
+
+	t.Run("MaintenanceRelease", func(t *testing.T) {
+		if current == releaseDir {
+			t.Errorf("expected current to point to a new maintenance release")
+		}
+	})
+
+	t.Run("Returns503", func(t *testing.T) {
+		if !strings.Contains(vhost, "error_page 503 @myapp_maintenance;\nif ($myapp_maintenance) {\n  return 503;\n}") {
+			t.Errorf("expected maintenance 503, got: %s", vhost)
+		}
+	})
+
+	t.Run("RetryAfter", func(t *testing.T) {
+		if !strings.Contains(vhost, "add_header Retry-After 120 always;") {
+			t.Errorf("expected Retry-After, got: %s", vhost)
+		}
+	})
+
+	t.Run("PageRoot", func(t *testing.T) {
+		if !strings.Contains(vhost, "root "+current+";") {
+			t.Errorf("expected the page to be served from the release, got: %s", vhost)
+		}
+		if page := readMaintenanceTestFile(t, current, maintenancePageFile); page != "<h1>maintenance</h1>" {
+			t.Errorf("unexpected maintenance page: %s", page)
+		}
+	})
+
+	t.Run("KeepsLocations", func(t *testing.T) {
+		if !strings.Contains(vhost, "location / {\n  proxy_pass http://myapp-web-5000;\n}") {
+			t.Errorf("expected the app locations to be kept, got: %s", vhost)
+		}
+		if upstreams := readMaintenanceTestFile(t, current, "upstreams.conf"); upstreams != "upstream myapp-web-5000 {\n}\n" {
+			t.Errorf("expected upstreams to be copied as-is, got: %s", upstreams)
+		}
+	})
+
+	t.Run("AllowList", func(t *testing.T) {
+		geo := nginxBlock(readMaintenanceTestFile(t, current, "maps.conf"), "geo $myapp_maintenance")
+		for _, entry := range []string{"default 1;", "10.0.0.0/8 0;", "192.0.2.1 0;"} {
+			if !strings.Contains(geo, entry) {
+				t.Errorf("expected %q in the maintenance geo, got: %s", entry, geo)
+			}
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		updated := opts
+		updated.allow = nil
+		if err := runMaintenance("myapp", configDir, updated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if again, _ := getPreviousVersionDirectory(configDir); again != current {
+			t.Errorf("expected maintenance release %s to be reused, got %s", current, again)
+		}
+		if maps := readMaintenanceTestFile(t, current, "maps.conf"); strings.Contains(maps, "10.0.0.0/8") {
+			t.Errorf("expected allow list to be updated, got: %s", maps)
+		}
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		off := opts
+		off.mode = "off"
+		if err := runMaintenance("myapp", configDir, off); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if restored, _ := getPreviousVersionDirectory(configDir); restored != releaseDir {
+			t.Errorf("expected current to be restored to %s, got %s", releaseDir, restored)
+		}
+		if _, err := os.Stat(current); !os.IsNotExist(err) {
+			t.Errorf("expected maintenance release to be removed")
+		}
+		if err := runMaintenance("myapp", configDir, off); err == nil {
+			t.Errorf("expected error when maintenance is already off")
+		}
+	})
+}
+
+func TestRunMaintenanceFailedNginxTest(t *testing.T) {
+	assertCurrent := func(t *testing.T, configDir string, expectedCurrent string) {
+		t.Helper()
+		if current, _ := getPreviousVersionDirectory(configDir); current != expectedCurrent {
+			t.Errorf("expected current to stay %s, got %s", expectedCurrent, current)
+		}
+		latest, err := getCurrentConfigVersionDirectory(configDir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if latest != expectedCurrent {
+			t.Errorf("expected latest release to stay %s, got %s", expectedCurrent, latest)
+		}
+		if tmpDirs, _ := filepath.Glob(filepath.Join(configDir, "*.tmp")); len(tmpDirs) > 0 {
+			t.Errorf("expected temporary releases to be removed, got %v", tmpDirs)
+		}
+	}
+	// turnOn puts the release in maintenance with a passing nginx test.
+	turnOn := func(t *testing.T, configDir string, opts maintenanceOptions) string {
+		t.Helper()
+		opts.nginxTestCommand = []string{"true"}
+		if err := runMaintenance("myapp", configDir, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		maintenanceDir, _ := getPreviousVersionDirectory(configDir)
+		if state, err := readMaintenanceState(maintenanceDir); err != nil || state == nil {
+			t.Fatalf("expected maintenance state in %s, got %v, %v", maintenanceDir, state, err)
+		}
+		return maintenanceDir
+	}
+
+	t.Run("On", func(t *testing.T) {
+		configDir, releaseDir, opts := newMaintenanceTestRelease(t)
+		opts.nginxTestCommand = []string{"false"}
+		if err := runMaintenance("myapp", configDir, opts); err == nil {
+			t.Fatalf("expected the failed nginx test to be reported")
+		}
+		assertCurrent(t, configDir, releaseDir)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		configDir, _, opts := newMaintenanceTestRelease(t)
+		maintenanceDir := turnOn(t, configDir, opts)
+
+		opts.retryAfter = 300
+		opts.nginxTestCommand = []string{"false"}
+		if err := runMaintenance("myapp", configDir, opts); err == nil {
+			t.Fatalf("expected the failed nginx test to be reported")
+		}
+		assertCurrent(t, configDir, maintenanceDir)
+		if vhost := readMaintenanceTestFile(t, maintenanceDir, "vhosts/example.com/vhost.conf"); !strings.Contains(vhost, "Retry-After 120") {
+			t.Errorf("expected the maintenance release to be unchanged, got: %s", vhost)
+		}
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		configDir, _, opts := newMaintenanceTestRelease(t)
+		maintenanceDir := turnOn(t, configDir, opts)
+
+		opts.mode = "off"
+		opts.nginxTestCommand = []string{"false"}
+		if err := runMaintenance("myapp", configDir, opts); err == nil {
+			t.Fatalf("expected the failed nginx test to be reported")
+		}
+		assertCurrent(t, configDir, maintenanceDir)
+		if _, err := os.Stat(maintenanceDir); err != nil {
+			t.Errorf("expected the maintenance release to be kept: %v", err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"strconv"
+)
+
+// mirrorLocationUri is the internal location mirrored requests are sent to.
+// nginx only mirrors to URIs, so it follows the named location prefixing
+// instead of being a named location.
+func mirrorLocationUri(appName string, locationIndex int) string {
+	return fmt.Sprintf("/_%s_mirror_%d", appName, locationIndex)
+}
+
+func mirrorSampleVariable(appName string, serverName string, locationIndex int) string {
+	return nginxVariableName(appName, "mirror", serverName, strconv.Itoa(locationIndex))
+}
+
+func mirrorSampled(mirror *file_config.MirrorConfig) bool {
+	return mirror.Percent > 0 && mirror.Percent < 100
+}
+
+// buildMirrorMapConfig renders the split_clients blocks sampling mirrored
+// requests.
+func buildMirrorMapConfig(appName string, config *file_config.Config) string {
+	cfgStr := ""
+	for _, vhost := range config.Vhosts {
+		for locationIndex, location := range vhost.Locations {
+			if location.Mirror == nil || !mirrorSampled(location.Mirror) {
+				continue
+			}
+			cfgStr += fmt.Sprintf(`split_clients "${request_id}" $%s {
+  %s%% 1;
+  * "";
+}
+`, mirrorSampleVariable(appName, vhost.ServerName, locationIndex), strconv.FormatFloat(location.Mirror.Percent, 'f', -1, 64))
+		}
+	}
+	return cfgStr
+}
+
+// buildMirrorLines renders the mirror directives of a location and the
+// internal location proxying mirrored requests to the upstream.
+func buildMirrorLines(appName string, serverName string, locationIndex int, mirror *file_config.MirrorConfig, upstreams upstreamResultingNames) ([]string, string, error) {
+	generatedUpstreamName, ok := upstreams[mirror.Upstream]
+	if !ok {
+		return nil, "", fmt.Errorf("mirror upstream %q not found", mirror.Upstream)
+	}
+
+	uri := mirrorLocationUri(appName, locationIndex)
+	body := "off"
+	if mirror.Body {
+		body = "on"
+	}
+	lines := []string{
+		fmt.Sprintf("mirror %s;", uri),
+		fmt.Sprintf("mirror_request_body %s;", body),
+	}
+
+	location := fmt.Sprintf("location = %s {\n  internal;\n", uri)
+	if mirrorSampled(mirror) {
+		location += fmt.Sprintf("  if ($%s = \"\") {\n    return 204;\n  }\n", mirrorSampleVariable(appName, serverName, locationIndex))
+	}
+	if !mirror.Body {
+		location += "  proxy_pass_request_body off;\n  proxy_set_header Content-Length \"\";\n"
+	}
+	location += fmt.Sprintf(`  proxy_pass http://%s$request_uri;
+  proxy_set_header Host $http_host;
+  proxy_set_header X-Real-IP $remote_addr;
+  proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+  proxy_set_header X-Forwarded-Proto $scheme;
+}
+`, generatedUpstreamName)
+
+	return lines, location, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_Mirror(t *testing.T) {
+	newConfig := func() *file_config.Config {
+		return &file_config.Config{
+			UserVars: file_config.ConfigVars{},
+			SysVars:  file_config.ConfigVars{},
+			Vhosts: []file_config.VhostConfig{
+				{
+					ServerName: "example.com",
+					Locations: []file_config.LocationConfig{
+						{
+							Uri:    "/api/",
+							Mirror: &file_config.MirrorConfig{Upstream: "web-v2-5000", Percent: 12.5},
+							Body:   "proxy_pass http://{{ .upstreams.default }};",
+						},
+						{
+							Uri:    "/upload/",
+							Mirror: &file_config.MirrorConfig{Upstream: "web-v2-5000", Body: true},
+							Body:   "proxy_pass http://{{ .upstreams.default }};",
+						},
+					},
+				},
+			},
+		}
+	}
+	data := &locationConfigData{upstreams: upstreamResultingNames{
+		"default":     "myapp-web-5000",
+		"web-v2-5000": "myapp-web-v2-5000",
+	}}
+	locationConfigs, _, err := buildLocationConfig("myapp", newConfig(), data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := locationConfigs["example.com"]
+	api := nginxBlock(out, "location /api/")
+	upload := nginxBlock(out, "location /upload/")
+	apiMirror := nginxBlock(out, "location = /_myapp_mirror_0")
+	uploadMirror := nginxBlock(out, "location = /_myapp_mirror_1")
+
+	t.Run("Mirror", func(t *testing.T) {
+		if !strings.Contains(api, "mirror /_myapp_mirror_0;") {
+			t.Errorf("expected mirror directive, got: %s", api)
+		}
+		if !strings.Contains(upload, "mirror /_myapp_mirror_1;") {
+			t.Errorf("expected mirror directive, got: %s", upload)
+		}
+	})
+
+	t.Run("MirrorLocation", func(t *testing.T) {
+		for _, directive := range []string{"internal;", "proxy_pass http://myapp-web-v2-5000$request_uri;"} {
+			if !strings.Contains(apiMirror, directive) {
+				t.Errorf("expected %q, got: %s", directive, apiMirror)
+			}
+		}
+	})
+
+	t.Run("RequestBodyOff", func(t *testing.T) {
+		if !strings.Contains(api, "mirror_request_body off;") {
+			t.Errorf("expected mirror_request_body off, got: %s", api)
+		}
+		if !strings.Contains(apiMirror, "proxy_pass_request_body off;") {
+			t.Errorf("expected proxy_pass_request_body off, got: %s", apiMirror)
+		}
+	})
+
+	t.Run("RequestBodyOn", func(t *testing.T) {
+		if !strings.Contains(upload, "mirror_request_body on;") {
+			t.Errorf("expected mirror_request_body on, got: %s", upload)
+		}
+		if strings.Contains(uploadMirror, "proxy_pass_request_body") {
+			t.Errorf("expected the body to be passed, got: %s", uploadMirror)
+		}
+	})
+
+	t.Run("Sampling", func(t *testing.T) {
+		if !strings.Contains(apiMirror, "if ($myapp_mirror_example_com_0 = \"\") {\n    return 204;\n  }") {
+			t.Errorf("expected unsampled requests to be dropped, got: %s", apiMirror)
+		}
+		if strings.Contains(uploadMirror, "if (") {
+			t.Errorf("expected every request to be mirrored, got: %s", uploadMirror)
+		}
+	})
+
+	t.Run("SplitClients", func(t *testing.T) {
+		mapCfg := buildMirrorMapConfig("myapp", newConfig())
+		block := nginxBlock(mapCfg, "split_clients \"${request_id}\" $myapp_mirror_example_com_0")
+		if !strings.Contains(block, "12.5% 1;") {
+			t.Errorf("expected the sampled percentage, got: %s", mapCfg)
+		}
+		if strings.Count(mapCfg, "split_clients") != 1 {
+			t.Errorf("expected split_clients only for the sampled mirror, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("UnknownUpstream", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Vhosts[0].Locations[1].Mirror.Upstream = "missing"
+		if _, _, err := buildLocationConfig("myapp", cfg, data); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("expected missing upstream error, got: %v", err)
+		}
+	})
+}
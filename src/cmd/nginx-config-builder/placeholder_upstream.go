@@ -0,0 +1,110 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+func placeholderUpstreamName(appName string) string {
+	return fmt.Sprintf("%s-placeholder", appName)
+}
+
+// upstreamTemplateRefPattern matches the upstream references of templates,
+// written `.upstreams.name` or `index .upstreams "name"`.
+var upstreamTemplateRefPattern = regexp.MustCompile(`\.upstreams\.([A-Za-z0-9_]+)|index\s+\.upstreams\s+"([^"]+)"`)
+
+// processUpstreamRefPattern matches the references generated for the
+// listeners of a process type, such as web-5000 or worker-5000.
+var processUpstreamRefPattern = regexp.MustCompile(`^(.+)-(\d+)$`)
+
+// vhostUpstreamRefs returns the upstreams referenced by the vhosts, in their
+// templates or upstream fields, that buildUpstreamConfig generates for a
+// process type of the app when it has listeners. Other names are left out so
+// they keep failing as unknown upstreams.
+func vhostUpstreamRefs(config *file_config.Config, processTypes []string, ports []string) []string {
+	refs := make([]string, 0)
+	add := func(ref string) {
+		match := processUpstreamRefPattern.FindStringSubmatch(ref)
+		if match == nil || !slices.Contains(processTypes, match[1]) || !slices.Contains(ports, match[2]) {
+			return
+		}
+		if !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	addTemplate := func(tmpl string) {
+		for _, match := range upstreamTemplateRefPattern.FindAllStringSubmatch(tmpl, -1) {
+			add(match[1] + match[2])
+		}
+	}
+	for _, vhost := range config.Vhosts {
+		addTemplate(vhost.InServerBlock)
+		for _, location := range vhost.Locations {
+			addTemplate(location.Body)
+			if location.Grpc != nil {
+				add(location.Grpc.Upstream)
+			}
+			if location.Mirror != nil {
+				add(location.Mirror.Upstream)
+			}
+			if location.AuthRequest != nil {
+				add(location.AuthRequest.Upstream)
+			}
+			if location.Static != nil && location.Static.Fallback != "" {
+				add(location.Static.Fallback)
+			}
+		}
+	}
+	return refs
+}
+
+// addPlaceholderUpstreams points the upstream references that are missing,
+// because the process type has no listeners (scaled to zero, or
+// DOKKU_APP_LISTENERS is invalid), to a local responder answering 503. This
+// way location bodies never render `proxy_pass http://;`. Besides the default
+// ones, the vhost references to the upstreams of processTypes, the process
+// types of the app, are covered. It returns the upstream and server blocks to
+// add to upstreams.conf.
+func addPlaceholderUpstreams(appName string, config *file_config.Config, processTypes []string, data *upstreamConfigTemplateData, upstreams upstreamResultingNames, socketPath string) string {
+	refs := []string{"default"}
+	for _, port := range data.UpstreamPorts {
+		if port == "" {
+			continue
+		}
+		refs = append(refs, fmt.Sprintf("default-%s", port), fmt.Sprintf("web-%s", port))
+	}
+	for _, ref := range vhostUpstreamRefs(config, processTypes, data.UpstreamPorts) {
+		if !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+
+	name := placeholderUpstreamName(appName)
+	missing := make([]string, 0)
+	for _, ref := range refs {
+		if _, ok := upstreams[ref]; ok {
+			continue
+		}
+		upstreams[ref] = name
+		missing = append(missing, ref)
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+
+	log.Printf("[warn] no listeners for upstreams %s, proxying them to a placeholder answering 503\n", strings.Join(missing, ", "))
+	return fmt.Sprintf(`upstream %[1]s {
+  server unix:%[2]s;
+}
+
+server {
+  listen unix:%[2]s;
+  default_type text/plain;
+  return 503 "%[3]s has no running processes\n";
+}
+`, name, socketPath, appName)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestAddPlaceholderUpstreams(t *testing.T) {
+	newConfig := func(locations ...file_config.LocationConfig) *file_config.Config {
+		return &file_config.Config{
+			UserVars: file_config.ConfigVars{},
+			SysVars:  file_config.ConfigVars{},
+			Vhosts:   []file_config.VhostConfig{{ServerName: "example.com", Locations: locations}},
+		}
+	}
+	build := func(t *testing.T, cfg *file_config.Config, processTypes []string, listeners map[string][]string) (string, upstreamResultingNames) {
+		t.Helper()
+		data := &upstreamConfigTemplateData{App: "myapp", AppListeners: listeners, UpstreamPorts: []string{"5000"}}
+		upstreamCfg, upstreams, err := buildUpstreamConfig("myapp", cfg, data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return upstreamCfg + addPlaceholderUpstreams("myapp", cfg, processTypes, data, upstreams, "/run/myapp-placeholder.sock"), upstreams
+	}
+
+	t.Run("NoListeners", func(t *testing.T) {
+		upstreamCfg, upstreams := build(t, newConfig(), []string{"web"}, map[string][]string{})
+		for _, ref := range []string{"default", "default-5000", "web-5000"} {
+			if upstreams[ref] != "myapp-placeholder" {
+				t.Errorf("expected %s to use the placeholder upstream, got %q", ref, upstreams[ref])
+			}
+		}
+		if !strings.Contains(upstreamCfg, "upstream myapp-placeholder {\n  server unix:/run/myapp-placeholder.sock;\n}") {
+			t.Errorf("expected the placeholder upstream, got: %s", upstreamCfg)
+		}
+		if !strings.Contains(upstreamCfg, "return 503 \"myapp has no running processes\\n\";") {
+			t.Errorf("expected the placeholder server to answer 503, got: %s", upstreamCfg)
+		}
+	})
+
+	t.Run("ProxyPassRendersPlaceholder", func(t *testing.T) {
+		cfg := newConfig(file_config.LocationConfig{Uri: "/", Body: "proxy_pass http://{{ .upstreams.default }};"})
+		_, upstreams := build(t, cfg, []string{"web"}, map[string][]string{})
+		locationConfigs, _, err := buildLocationConfig("myapp", cfg, &locationConfigData{upstreams: upstreams})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(locationConfigs["example.com"], "proxy_pass http://myapp-placeholder;") {
+			t.Errorf("expected placeholder proxy_pass, got: %s", locationConfigs["example.com"])
+		}
+	})
+
+	t.Run("WithListeners", func(t *testing.T) {
+		extra, _ := build(t, newConfig(), []string{"web"}, map[string][]string{"web": {"10.0.0.1"}})
+		if strings.Contains(extra, "placeholder") {
+			t.Errorf("expected no placeholder with listeners, got: %s", extra)
+		}
+	})
+
+	t.Run("ScaledDownProcessType", func(t *testing.T) {
+		cfg := newConfig(file_config.LocationConfig{Uri: "/jobs", Body: `proxy_pass http://{{ index .upstreams "worker-5000" }};`})
+		_, upstreams := build(t, cfg, []string{"web", "worker"}, map[string][]string{"web": {"10.0.0.1"}})
+		if upstreams["worker-5000"] != "myapp-placeholder" {
+			t.Errorf("expected worker-5000 to use the placeholder upstream, got %q", upstreams["worker-5000"])
+		}
+		if upstreams["web-5000"] != "myapp-web-5000" {
+			t.Errorf("expected web-5000 to keep its upstream, got %q", upstreams["web-5000"])
+		}
+	})
+
+	t.Run("UnknownProcessType", func(t *testing.T) {
+		cfg := newConfig(file_config.LocationConfig{Uri: "/events", Mirror: &file_config.MirrorConfig{Upstream: "events-5000"}, Body: "return 204;"})
+		_, upstreams := build(t, cfg, []string{"web"}, map[string][]string{"web": {"10.0.0.1"}})
+		if _, ok := upstreams["events-5000"]; ok {
+			t.Fatalf("expected no placeholder for a process type the app doesn't have")
+		}
+		if _, _, err := buildLocationConfig("myapp", cfg, &locationConfigData{upstreams: upstreams}); err == nil {
+			t.Errorf("expected the unknown mirror upstream to fail the build")
+		}
+	})
+
+	t.Run("UnmappedPort", func(t *testing.T) {
+		cfg := newConfig(file_config.LocationConfig{Uri: "/jobs", Body: `proxy_pass http://{{ index .upstreams "worker-8080" }};`})
+		_, upstreams := build(t, cfg, []string{"web", "worker"}, map[string][]string{})
+		if _, ok := upstreams["worker-8080"]; ok {
+			t.Errorf("expected no placeholder for a port the app doesn't proxy")
+		}
+	})
+}
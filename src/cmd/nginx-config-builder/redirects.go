@@ -0,0 +1,180 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// redirectsMapThreshold is the number of exact redirects of a vhost above which
+// they are compiled to map lookups instead of one location per rule.
+const redirectsMapThreshold = 20
+
+const redirectDefaultCode = 301
+
+// loadRedirectsFiles appends the rules of every vhost redirects_file to the
+// vhost redirects and validates the result.
+func loadRedirectsFiles(config *file_config.Config, readImageFile imageFileReader) error {
+	for i := range config.Vhosts {
+		vhost := &config.Vhosts[i]
+		if vhost.RedirectsFile == "" {
+			continue
+		}
+		content, err := readImageFile(vhost.RedirectsFile)
+		if err != nil {
+			return fmt.Errorf("vhost %s: %w", vhost.ServerName, err)
+		}
+		redirects, err := file_config.ParseRedirects(vhost.RedirectsFile, content)
+		if err != nil {
+			return fmt.Errorf("vhost %s: %w", vhost.ServerName, err)
+		}
+		vhost.Redirects = append(vhost.Redirects, redirects...)
+		if err := file_config.ValidateRedirects(vhost.ServerName, vhost.Redirects); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func redirectCode(redirect file_config.RedirectConfig) int {
+	if redirect.Code == 0 {
+		return redirectDefaultCode
+	}
+	return redirect.Code
+}
+
+func redirectTarget(redirect file_config.RedirectConfig, suffix string) string {
+	target := redirect.To + suffix
+	if redirect.PreserveQuery {
+		target += "$is_args$args"
+	}
+	return target
+}
+
+func isExactRedirect(redirect file_config.RedirectConfig) bool {
+	return redirect.Match == "" || redirect.Match == "exact"
+}
+
+// redirectsUseMap tells whether the redirects of a vhost are compiled to $uri
+// lookup maps. Prefix and regex rules always are, so they don't take one regex
+// location each; exact rules only above redirectsMapThreshold, and then all of
+// them, so exact rules keep precedence over the regex ones.
+func redirectsUseMap(vhost file_config.VhostConfig) bool {
+	count := 0
+	for _, redirect := range vhost.Redirects {
+		if !isExactRedirect(redirect) {
+			return true
+		}
+		count++
+	}
+	return count > redirectsMapThreshold
+}
+
+// redirectCodes returns the status codes used by the redirects of a vhost, as
+// `return` needs a literal code.
+func redirectCodes(vhost file_config.VhostConfig) []int {
+	codes := make([]int, 0)
+	for _, redirect := range vhost.Redirects {
+		if code := redirectCode(redirect); !slices.Contains(codes, code) {
+			codes = append(codes, code)
+		}
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+// redirectMapKey returns the map key matching the $uri a redirect applies to,
+// and the suffix appended to its target.
+func redirectMapKey(redirect file_config.RedirectConfig) (string, string) {
+	switch redirect.Match {
+	case "prefix":
+		return "~^" + regexp.QuoteMeta(redirect.From) + "(.*)$", "$1"
+	case "regex":
+		return "~" + redirect.From, ""
+	}
+	return redirect.From, ""
+}
+
+func redirectMapVariable(appName string, serverName string) string {
+	return nginxVariableName(appName, "redirect", serverName)
+}
+
+func redirectCodeMapVariable(appName string, serverName string) string {
+	return nginxVariableName(appName, "redirect", serverName, "code")
+}
+
+// buildRedirectMapConfig renders the $uri lookup maps of the target, and of the
+// status code when there are several, of vhosts using redirect maps. nginx
+// checks the exact keys first, then the regex ones in order.
+func buildRedirectMapConfig(appName string, config *file_config.Config) (string, error) {
+	cfgStr := ""
+	for _, vhost := range config.Vhosts {
+		if !redirectsUseMap(vhost) {
+			continue
+		}
+		cfgStr += fmt.Sprintf("map $uri $%s {\n  default \"\";\n", redirectMapVariable(appName, vhost.ServerName))
+		for _, redirect := range vhost.Redirects {
+			key, suffix := redirectMapKey(redirect)
+			cfgStr += fmt.Sprintf("  %s %s;\n", nginxQuote(key), nginxQuote(redirectTarget(redirect, suffix)))
+		}
+		cfgStr += "}\n"
+
+		if len(redirectCodes(vhost)) > 1 {
+			cfgStr += fmt.Sprintf("map $uri $%s {\n  default \"\";\n", redirectCodeMapVariable(appName, vhost.ServerName))
+			for _, redirect := range vhost.Redirects {
+				key, _ := redirectMapKey(redirect)
+				cfgStr += fmt.Sprintf("  %s %d;\n", nginxQuote(key), redirectCode(redirect))
+			}
+			cfgStr += "}\n"
+		}
+	}
+	return cfgStr, nil
+}
+
+// redirectLocationConflicts returns the exact redirects of a vhost that have
+// the same path as one of its `location =`, which nginx rejects as a duplicate
+// location.
+func redirectLocationConflicts(vhost file_config.VhostConfig) []string {
+	exactLocations := make(map[string]bool)
+	for _, location := range vhost.Locations {
+		if strings.TrimSpace(location.Modifier) == "=" {
+			exactLocations[strings.TrimSpace(location.Uri)] = true
+		}
+	}
+	conflicts := make([]string, 0)
+	for _, redirect := range vhost.Redirects {
+		if isExactRedirect(redirect) && exactLocations[redirect.From] {
+			conflicts = append(conflicts, redirect.From)
+		}
+	}
+	return conflicts
+}
+
+// buildRedirectConfig renders the redirects of a vhost: server-level lookups
+// when it uses redirect maps, one `location =` per rule otherwise.
+func buildRedirectConfig(appName string, vhost file_config.VhostConfig) (string, error) {
+	cfgStr := ""
+
+	if redirectsUseMap(vhost) {
+		variable := redirectMapVariable(appName, vhost.ServerName)
+		codes := redirectCodes(vhost)
+		if len(codes) == 1 {
+			return fmt.Sprintf("if ($%s) {\n  return %d $%s;\n}\n\n", variable, codes[0], variable), nil
+		}
+		codeVariable := redirectCodeMapVariable(appName, vhost.ServerName)
+		for _, code := range codes {
+			cfgStr += fmt.Sprintf("if ($%s = %d) {\n  return %d $%s;\n}\n\n", codeVariable, code, code, variable)
+		}
+		return cfgStr, nil
+	}
+
+	if conflicts := redirectLocationConflicts(vhost); len(conflicts) > 0 {
+		return "", fmt.Errorf("redirects from %s conflict with a location = of the same path", strings.Join(conflicts, ", "))
+	}
+	for _, redirect := range vhost.Redirects {
+		cfgStr += fmt.Sprintf("location = %s {\n  return %d %s;\n}\n\n", nginxQuote(redirect.From), redirectCode(redirect), nginxQuote(redirectTarget(redirect, "")))
+	}
+	return cfgStr, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildRedirectConfig(t *testing.T) {
+	vhost := file_config.VhostConfig{
+		ServerName: "example.com",
+		Redirects: []file_config.RedirectConfig{
+			{From: "/promo", To: "/campaigns/summer", Code: 302, PreserveQuery: true},
+			{From: "/café", To: "/shop\t\"new\""},
+		},
+	}
+	out, err := buildRedirectConfig("my-app", vhost)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("ExactLocation", func(t *testing.T) {
+		location := nginxBlock(out, `location = "/promo"`)
+		if !strings.Contains(location, `return 302 "/campaigns/summer$is_args$args";`) {
+			t.Errorf("expected a 302 keeping the query string, got: %s", out)
+		}
+	})
+
+	t.Run("QuotedTarget", func(t *testing.T) {
+		location := nginxBlock(out, `location = "/café"`)
+		if !strings.Contains(location, "return 301 \"/shop\t\\\"new\\\"\";") {
+			t.Errorf("expected an escaped 301 target, got: %s", out)
+		}
+	})
+
+	t.Run("NoMap", func(t *testing.T) {
+		mapCfg, err := buildRedirectMapConfig("my-app", &file_config.Config{Vhosts: []file_config.VhostConfig{vhost}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if mapCfg != "" {
+			t.Errorf("expected no redirect map for a few exact redirects, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("Conflicts", func(t *testing.T) {
+		conflicting := file_config.VhostConfig{
+			ServerName: "example.com",
+			Locations: []file_config.LocationConfig{
+				{Modifier: "=", Uri: "/promo", Body: "return 200;"},
+				{Uri: "/old", Body: "return 200;"},
+			},
+			Redirects: []file_config.RedirectConfig{
+				{From: "/promo", To: "/campaigns/summer"},
+				{From: "/old", To: "/new"},
+			},
+		}
+		_, err := buildRedirectConfig("my-app", conflicting)
+		if err == nil || !strings.Contains(err.Error(), "/promo") || strings.Contains(err.Error(), "/old") {
+			t.Errorf("expected a conflict for /promo only, got %v", err)
+		}
+	})
+}
+
+func TestBuildRedirectConfig_Map(t *testing.T) {
+	vhost := file_config.VhostConfig{
+		ServerName: "example.com",
+		Redirects: []file_config.RedirectConfig{
+			{From: "/promo", To: "/campaigns/summer", Code: 302, PreserveQuery: true},
+			{From: "/docs/", To: "https://docs.example.com/", Match: "prefix"},
+			{From: `^/p/(\d+)$`, To: "/products/$1", Match: "regex", Code: 308},
+		},
+	}
+	mapCfg, err := buildRedirectMapConfig("my-app", &file_config.Config{Vhosts: []file_config.VhostConfig{vhost}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out, err := buildRedirectConfig("my-app", vhost)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("TargetMap", func(t *testing.T) {
+		block := nginxBlock(mapCfg, "map $uri $my_app_redirect_example_com")
+		for _, entry := range []string{
+			`default "";`,
+			`"/promo" "/campaigns/summer$is_args$args";`,
+			`"~^/docs/(.*)$" "https://docs.example.com/$1";`,
+			`"~^/p/(\\d+)$" "/products/$1";`,
+		} {
+			if !strings.Contains(block, entry) {
+				t.Errorf("expected %q in the redirect map, got: %s", entry, mapCfg)
+			}
+		}
+	})
+
+	t.Run("CodeMap", func(t *testing.T) {
+		block := nginxBlock(mapCfg, "map $uri $my_app_redirect_example_com_code")
+		for _, entry := range []string{`"/promo" 302;`, `"~^/docs/(.*)$" 301;`, `"~^/p/(\\d+)$" 308;`} {
+			if !strings.Contains(block, entry) {
+				t.Errorf("expected %q in the code map, got: %s", entry, mapCfg)
+			}
+		}
+	})
+
+	t.Run("NoLocations", func(t *testing.T) {
+		if strings.Contains(out, "location") {
+			t.Errorf("expected no redirect locations when using maps, got: %s", out)
+		}
+	})
+
+	for _, code := range []int{301, 302, 308} {
+		t.Run(fmt.Sprintf("Lookup%d", code), func(t *testing.T) {
+			lookup := nginxBlock(out, fmt.Sprintf("if ($my_app_redirect_example_com_code = %d)", code))
+			if !strings.Contains(lookup, fmt.Sprintf("return %d $my_app_redirect_example_com;", code)) {
+				t.Errorf("expected a %d lookup, got: %s", code, out)
+			}
+		})
+	}
+}
+
+func TestBuildRedirectConfig_ManyPrefixes(t *testing.T) {
+	vhost := file_config.VhostConfig{ServerName: "example.com"}
+	for i := 0; i < 500; i++ {
+		vhost.Redirects = append(vhost.Redirects, file_config.RedirectConfig{From: fmt.Sprintf("/old/%d.x/", i), To: fmt.Sprintf("/new/%d/", i), Match: "prefix"})
+	}
+	mapCfg, err := buildRedirectMapConfig("my-app", &file_config.Config{Vhosts: []file_config.VhostConfig{vhost}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Run("PrefixEntries", func(t *testing.T) {
+		if strings.Count(mapCfg, "\n  \"~^/old/") != 500 {
+			t.Errorf("expected 500 prefix map entries, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("EscapedPrefix", func(t *testing.T) {
+		if !strings.Contains(mapCfg, `"~^/old/499\\.x/(.*)$" "/new/499/$1";`) {
+			t.Errorf("expected escaped prefix map entry, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("NoCodeMap", func(t *testing.T) {
+		if strings.Contains(mapCfg, "_code") {
+			t.Errorf("expected no code map for a single status code, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("SingleLookup", func(t *testing.T) {
+		out, err := buildRedirectConfig("my-app", vhost)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "if ($my_app_redirect_example_com) {\n  return 301 $my_app_redirect_example_com;\n}\n\n"
+		if out != expected {
+			t.Errorf("expected a single lookup %q, got: %s", expected, out)
+		}
+	})
+}
+
+func TestBuildRedirectConfig_ManyExact(t *testing.T) {
+	vhost := file_config.VhostConfig{ServerName: "example.com"}
+	for i := 0; i <= redirectsMapThreshold; i++ {
+		vhost.Redirects = append(vhost.Redirects, file_config.RedirectConfig{From: fmt.Sprintf("/go/%d", i), To: fmt.Sprintf("/target/%d", i)})
+	}
+
+	t.Run("Map", func(t *testing.T) {
+		mapCfg, err := buildRedirectMapConfig("my-app", &file_config.Config{Vhosts: []file_config.VhostConfig{vhost}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(nginxBlock(mapCfg, "map $uri $my_app_redirect_example_com"), `"/go/0" "/target/0";`) {
+			t.Errorf("expected redirect map, got: %s", mapCfg)
+		}
+	})
+
+	t.Run("NoLocations", func(t *testing.T) {
+		out, err := buildRedirectConfig("my-app", vhost)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if strings.Contains(out, "location") {
+			t.Errorf("expected no redirect locations when using maps, got: %s", out)
+		}
+	})
+}
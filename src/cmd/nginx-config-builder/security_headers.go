@@ -0,0 +1,56 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+)
+
+const hstsDefaultMaxAge = 31536000
+
+// buildSecurityHeadersLines renders the security headers of a vhost. The lines
+// are emitted at server level and repeated in every generated location, since
+// a location defining any add_header doesn't inherit the server-level ones.
+func buildSecurityHeadersLines(headers *file_config.SecurityHeadersConfig, addHeaderMode string) ([]string, error) {
+	lines := make([]string, 0)
+
+	if headers.Hsts != nil {
+		maxAge := headers.Hsts.MaxAge
+		if maxAge == 0 {
+			maxAge = hstsDefaultMaxAge
+		}
+		if headers.Hsts.Preload && (maxAge < hstsDefaultMaxAge || !headers.Hsts.IncludeSubdomains) {
+			return nil, fmt.Errorf("hsts preload requires max_age of at least %d and include_subdomains", hstsDefaultMaxAge)
+		}
+
+		value := fmt.Sprintf("max-age=%d", maxAge)
+		if headers.Hsts.IncludeSubdomains {
+			value += "; includeSubDomains"
+		}
+		if headers.Hsts.Preload {
+			value += "; preload"
+		}
+		lines = append(lines, nginxAddHeader(addHeaderMode, "Strict-Transport-Security", nginxHeaderValue(addHeaderMode, value)))
+	}
+
+	if headers.Csp != nil {
+		name := "Content-Security-Policy"
+		if headers.Csp.ReportOnly {
+			name = "Content-Security-Policy-Report-Only"
+		}
+		lines = append(lines, nginxAddHeader(addHeaderMode, name, nginxHeaderValue(addHeaderMode, headers.Csp.Policy)))
+	}
+
+	if headers.FrameOptions != "" {
+		lines = append(lines, nginxAddHeader(addHeaderMode, "X-Frame-Options", nginxHeaderValue(addHeaderMode, headers.FrameOptions)))
+	}
+
+	if headers.ReferrerPolicy != "" {
+		lines = append(lines, nginxAddHeader(addHeaderMode, "Referrer-Policy", nginxHeaderValue(addHeaderMode, headers.ReferrerPolicy)))
+	}
+
+	if headers.PermissionsPolicy != "" {
+		lines = append(lines, nginxAddHeader(addHeaderMode, "Permissions-Policy", nginxHeaderValue(addHeaderMode, headers.PermissionsPolicy)))
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_SecurityHeaders(t *testing.T) {
+	newConfig := func() *file_config.Config {
+		return &file_config.Config{
+			UserVars: file_config.ConfigVars{},
+			SysVars:  file_config.ConfigVars{},
+			Vhosts: []file_config.VhostConfig{
+				{
+					ServerName: "example.com",
+					SecurityHeaders: &file_config.SecurityHeadersConfig{
+						Hsts:           &file_config.HstsConfig{IncludeSubdomains: true, Preload: true},
+						Csp:            &file_config.CspConfig{Policy: "default-src 'self'", ReportOnly: true},
+						FrameOptions:   "DENY",
+						ReferrerPolicy: "same-origin",
+					},
+					Locations: []file_config.LocationConfig{
+						{Uri: "/", Body: "add_header X-Custom 1;"},
+					},
+				},
+			},
+		}
+	}
+
+	locationConfigs, _, err := buildLocationConfig("myapp", newConfig(), &locationConfigData{addHeaderMode: "add_header"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := locationConfigs["example.com"]
+	location := nginxBlock(out, "location /")
+	server := strings.Replace(out, location, "", 1)
+
+	for name, directive := range map[string]string{
+		"Hsts":           `add_header Strict-Transport-Security "max-age=31536000; includeSubDomains; preload" always;`,
+		"CspReportOnly":  `add_header Content-Security-Policy-Report-Only "default-src 'self'" always;`,
+		"FrameOptions":   `add_header X-Frame-Options DENY always;`,
+		"ReferrerPolicy": `add_header Referrer-Policy same-origin always;`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if !strings.Contains(server, directive) {
+				t.Errorf("expected %q at server level, got: %s", directive, out)
+			}
+			// the location defines its own add_header, so it doesn't inherit the server ones
+			if !strings.Contains(location, directive) {
+				t.Errorf("expected %q repeated in the location, got: %s", directive, location)
+			}
+		})
+	}
+
+	t.Run("HstsPreloadShortMaxAge", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Vhosts[0].SecurityHeaders.Hsts = &file_config.HstsConfig{MaxAge: 300, Preload: true}
+		if _, _, err := buildLocationConfig("myapp", cfg, &locationConfigData{}); err == nil {
+			t.Errorf("expected error for hsts preload with short max_age")
+		}
+	})
+}
+
+func TestBuildSecurityHeadersLines_QuotedCsp(t *testing.T) {
+	headers := &file_config.SecurityHeadersConfig{
+		Csp: &file_config.CspConfig{Policy: `script-src 'sha256-abc' "https://cdn.example.com"; report-uri /csp\report`},
+	}
+
+	for mode, expected := range map[string]string{
+		"add_header":       `add_header Content-Security-Policy "script-src 'sha256-abc' \"https://cdn.example.com\"; report-uri /csp\\report" always;`,
+		"more_set_headers": `more_set_headers "Content-Security-Policy: script-src 'sha256-abc' \"https://cdn.example.com\"; report-uri /csp\\report";`,
+	} {
+		t.Run(mode, func(t *testing.T) {
+			lines, err := buildSecurityHeadersLines(headers, mode)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(lines) != 1 || lines[0] != expected {
+				t.Errorf("expected %q, got %q", expected, lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// containerFilesystem describes where the app container files live on the host.
+type containerFilesystem struct {
+	// mounts maps container mount destinations to their host source.
+	mounts map[string]string
+	// mergedDir is the host path of the container root filesystem.
+	mergedDir string
+	// workingDir is the image working directory, inside the container.
+	workingDir string
+}
+
+// resolveStaticRoot returns the host directory files of a static location are
+// served from, and checks that it exists.
+func resolveStaticRoot(static *file_config.StaticConfig, fsys containerFilesystem) (string, error) {
+	var root string
+	if static.Mount != "" {
+		source, ok := fsys.mounts[normalizePath(static.Mount)]
+		if !ok {
+			return "", fmt.Errorf("container mount %q not found", static.Mount)
+		}
+		root = filepath.Join(source, static.Path)
+	} else {
+		if fsys.mergedDir == "" {
+			return "", fmt.Errorf("cannot serve %q from the image: container filesystem is unknown", static.Path)
+		}
+		p := static.Path
+		if !filepath.IsAbs(p) {
+			p = filepath.Join("/", fsys.workingDir, p)
+		}
+		root = filepath.Join(fsys.mergedDir, p)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", fmt.Errorf("static root %s is not accessible: %w", root, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("static root %s is not a directory", root)
+	}
+	return root, nil
+}
+
+func staticExpiresVariable(appName string, serverName string, locationIndex int) string {
+	return nginxVariableName(appName, "static_expires", serverName, strconv.Itoa(locationIndex))
+}
+
+func staticFallbackName(appName string, locationIndex int) string {
+	return fmt.Sprintf("%s_static_%d", appName, locationIndex)
+}
+
+// buildStaticMapConfig renders the expires-by-extension maps of static locations.
+func buildStaticMapConfig(appName string, config *file_config.Config) (string, error) {
+	cfgStr := ""
+	for _, vhost := range config.Vhosts {
+		for locationIndex, location := range vhost.Locations {
+			if location.Static == nil || len(location.Static.Expires) == 0 {
+				continue
+			}
+
+			defaultValue := "off"
+			expires := make(map[string]string)
+			extensions := make([]string, 0, len(location.Static.Expires))
+			for ext, value := range location.Static.Expires {
+				if ext == "default" {
+					defaultValue = value
+					continue
+				}
+				ext = strings.TrimPrefix(ext, ".")
+				expires[ext] = value
+				extensions = append(extensions, ext)
+			}
+			slices.Sort(extensions)
+
+			cfgStr += fmt.Sprintf("map $uri $%s {\n  default %s;\n", staticExpiresVariable(appName, vhost.ServerName, locationIndex), defaultValue)
+			for _, ext := range extensions {
+				pattern := fmt.Sprintf("~*%s$", regexp.QuoteMeta("."+ext))
+				cfgStr += fmt.Sprintf("  %s %s;\n", nginxQuote(pattern), expires[ext])
+			}
+			cfgStr += "}\n"
+		}
+	}
+	return cfgStr, nil
+}
+
+// buildStaticLines renders the directives of a static location. The named
+// fallback location, if any, is returned separately.
+func buildStaticLines(appName string, vhost file_config.VhostConfig, locationIndex int, data *locationConfigData) ([]string, string, error) {
+	static := vhost.Locations[locationIndex].Static
+	root, err := resolveStaticRoot(static, data.containerFilesystem)
+	if err != nil {
+		return nil, "", err
+	}
+
+	lines := make([]string, 0)
+	if static.Alias {
+		lines = append(lines, fmt.Sprintf("alias %s;", nginxQuote(strings.TrimSuffix(root, "/")+"/")))
+	} else {
+		lines = append(lines, fmt.Sprintf("root %s;", nginxQuote(root)))
+	}
+
+	fallback := ""
+	tryFilesFallback := "=404"
+	if static.Fallback != "" {
+		generatedUpstreamName, ok := data.upstreams[static.Fallback]
+		if !ok {
+			return nil, "", fmt.Errorf("static fallback upstream %q not found", static.Fallback)
+		}
+		name := staticFallbackName(appName, locationIndex)
+		tryFilesFallback = "@" + name
+		fallback = fmt.Sprintf(`location @%s {
+  proxy_pass http://%s;
+  proxy_set_header Host $http_host;
+  proxy_set_header X-Real-IP $remote_addr;
+  proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+  proxy_set_header X-Forwarded-Proto $scheme;
+}
+`, name, generatedUpstreamName)
+	}
+	lines = append(lines, fmt.Sprintf("try_files $uri $uri/ %s;", tryFilesFallback))
+
+	if len(static.Expires) > 0 {
+		lines = append(lines, fmt.Sprintf("expires $%s;", staticExpiresVariable(appName, vhost.ServerName, locationIndex)))
+	}
+	if static.GzipStatic {
+		lines = append(lines, "gzip_static on;")
+	}
+
+	return lines, fallback, nil
+}
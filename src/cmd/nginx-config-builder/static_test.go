@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_Static(t *testing.T) {
+	mountSource := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountSource, "assets"), 0755); err != nil {
+		t.Fatalf("failed to create assets dir: %v", err)
+	}
+	mergedDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mergedDir, "app", "public"), 0755); err != nil {
+		t.Fatalf("failed to create public dir: %v", err)
+	}
+
+	newConfig := func() *file_config.Config {
+		return &file_config.Config{
+			UserVars: file_config.ConfigVars{},
+			SysVars:  file_config.ConfigVars{},
+			Vhosts: []file_config.VhostConfig{
+				{
+					ServerName: "example.com",
+					Locations: []file_config.LocationConfig{
+						{
+							Modifier: "^~",
+							Uri:      "/assets/",
+							Static: &file_config.StaticConfig{
+								Mount:      "/data/",
+								Path:       "assets",
+								Alias:      true,
+								Expires:    map[string]string{"css": "7d", ".js": "7d", "default": "1h"},
+								GzipStatic: true,
+							},
+						},
+						{
+							Uri:    "/",
+							Static: &file_config.StaticConfig{Path: "public", Fallback: "default"},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	data := &locationConfigData{
+		upstreams: upstreamResultingNames{"default": "myapp-web-5000"},
+		containerFilesystem: containerFilesystem{
+			mounts:     map[string]string{"/data": mountSource},
+			mergedDir:  mergedDir,
+			workingDir: "/app",
+		},
+	}
+
+	locationConfigs, _, err := buildLocationConfig("myapp", newConfig(), data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := locationConfigs["example.com"]
+	assets := nginxBlock(out, "location ^~/assets/")
+	root := nginxBlock(out, "location /")
+
+	t.Run("MountAlias", func(t *testing.T) {
+		if !strings.Contains(assets, "alias \""+filepath.Join(mountSource, "assets")+"/\";") {
+			t.Errorf("expected an alias to the mount source, got: %s", out)
+		}
+	})
+
+	t.Run("ImageRoot", func(t *testing.T) {
+		if !strings.Contains(root, "root \""+filepath.Join(mergedDir, "app", "public")+"\";") {
+			t.Errorf("expected a root in the image filesystem, got: %s", out)
+		}
+	})
+
+	t.Run("TryFiles", func(t *testing.T) {
+		if !strings.Contains(assets, "try_files $uri $uri/ =404;") {
+			t.Errorf("expected a 404 without fallback, got: %s", assets)
+		}
+		if !strings.Contains(root, "try_files $uri $uri/ @myapp_static_1;") {
+			t.Errorf("expected the fallback location, got: %s", root)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		fallback := nginxBlock(out, "location @myapp_static_1")
+		if !strings.Contains(fallback, "proxy_pass http://myapp-web-5000;") {
+			t.Errorf("expected the fallback to proxy to the upstream, got: %s", out)
+		}
+	})
+
+	t.Run("Expires", func(t *testing.T) {
+		if !strings.Contains(assets, "expires $myapp_static_expires_example_com_0;") {
+			t.Errorf("expected expires from the map, got: %s", assets)
+		}
+		if strings.Contains(root, "expires") {
+			t.Errorf("expected no expires without the option, got: %s", root)
+		}
+	})
+
+	t.Run("ExpiresMap", func(t *testing.T) {
+		mapCfg, err := buildStaticMapConfig("myapp", newConfig())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		block := nginxBlock(mapCfg, "map $uri $myapp_static_expires_example_com_0")
+		for _, entry := range []string{"default 1h;", `"~*\\.css$" 7d;`, `"~*\\.js$" 7d;`} {
+			if !strings.Contains(block, entry) {
+				t.Errorf("expected %q in the expires map, got: %s", entry, mapCfg)
+			}
+		}
+	})
+
+	t.Run("GzipStatic", func(t *testing.T) {
+		if !strings.Contains(assets, "gzip_static on;") {
+			t.Errorf("expected gzip_static, got: %s", assets)
+		}
+	})
+
+	t.Run("MissingRoot", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Vhosts[0].Locations[1].Static.Path = "missing"
+		if _, _, err := buildLocationConfig("myapp", cfg, data); err == nil {
+			t.Errorf("expected error for missing static root")
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gliderlabs/sigil"
+)
+
+func streamUpstreamName(appName string, streamName string) string {
+	return fmt.Sprintf("%s-stream-%s", appName, streamName)
+}
+
+// renderStreamDirectives renders the templated directives of a stream, adding
+// the trailing semicolon when missing.
+func renderStreamDirectives(config *file_config.Config, raw []string) ([]string, error) {
+	out := make([]string, 0, len(raw))
+	for _, d := range raw {
+		rendered, err := sigil.Execute([]byte(strings.TrimSpace(d)), map[string]any{"vars": config.UserVars, "sys_vars": config.SysVars}, "stream_directive")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stream directive template %q: %w", d, err)
+		}
+		line := strings.TrimSpace(rendered.String())
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, ";") {
+			line += ";"
+		}
+		out = append(out, line)
+	}
+	return out, nil
+}
+
+// buildStreamConfig renders the upstreams and servers of the streams section,
+// meant to be included in nginx's stream context.
+func buildStreamConfig(appName string, config *file_config.Config, data *upstreamConfigTemplateData) (string, error) {
+	cfgStr := ""
+	seen := make(map[string]bool)
+
+	for _, stream := range config.Streams {
+		if seen[stream.Name] {
+			return "", fmt.Errorf("duplicate stream %q", stream.Name)
+		}
+		seen[stream.Name] = true
+
+		listeners := data.AppListeners[stream.ProcessType]
+		if len(listeners) == 0 {
+			log.Printf("[warn] stream %q: process type %q has no listeners, skipping\n", stream.Name, stream.ProcessType)
+			continue
+		}
+
+		upstreamDirectives, err := renderStreamDirectives(config, stream.UpstreamDirectives)
+		if err != nil {
+			return "", fmt.Errorf("stream %q: %w", stream.Name, err)
+		}
+		directives, err := renderStreamDirectives(config, stream.Directives)
+		if err != nil {
+			return "", fmt.Errorf("stream %q: %w", stream.Name, err)
+		}
+
+		upstreamName := streamUpstreamName(appName, stream.Name)
+		cfgStr += fmt.Sprintf("upstream %s {\n", upstreamName)
+		for _, line := range upstreamDirectives {
+			cfgStr += fmt.Sprintf("  %s\n", line)
+		}
+		for _, listener := range listeners {
+			addr := strings.Split(listener, ":")[0]
+			cfgStr += fmt.Sprintf("  server %s:%d;\n", addr, stream.Port)
+		}
+		cfgStr += "}\n\nserver {\n"
+
+		for _, listen := range stream.Listen {
+			if stream.Protocol == "udp" {
+				listen += " udp"
+			}
+			cfgStr += fmt.Sprintf("  listen %s;\n", listen)
+		}
+		cfgStr += fmt.Sprintf("  proxy_pass %s;\n", upstreamName)
+		for _, line := range directives {
+			cfgStr += fmt.Sprintf("  %s\n", line)
+		}
+		cfgStr += "}\n\n"
+	}
+
+	return cfgStr, nil
+}
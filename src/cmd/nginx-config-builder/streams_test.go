@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildStreamConfig(t *testing.T) {
+	cfg := &file_config.Config{
+		UserVars: file_config.ConfigVars{"timeout": "10m"},
+		SysVars:  file_config.ConfigVars{},
+		Streams: []file_config.StreamConfig{
+			{
+				Name:               "mqtt",
+				ProcessType:        "mqtt",
+				Port:               1883,
+				Listen:             []string{"1883", "[::]:1883"},
+				UpstreamDirectives: []string{"least_conn"},
+				Directives:         []string{"proxy_timeout {{ .vars.timeout }}"},
+			},
+			{Name: "dns", ProcessType: "dns", Port: 53, Listen: []string{"5353"}, Protocol: "udp"},
+			{Name: "idle", ProcessType: "worker", Port: 9000, Listen: []string{"9000"}},
+		},
+	}
+	data := &upstreamConfigTemplateData{
+		App: "myapp",
+		AppListeners: map[string][]string{
+			"mqtt": {"10.0.0.1:5000", "10.0.0.2"},
+			"dns":  {"10.0.0.3"},
+		},
+	}
+
+	out, err := buildStreamConfig("myapp", cfg, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `upstream myapp-stream-mqtt {
+  least_conn;
+  server 10.0.0.1:1883;
+  server 10.0.0.2:1883;
+}
+
+server {
+  listen 1883;
+  listen [::]:1883;
+  proxy_pass myapp-stream-mqtt;
+  proxy_timeout 10m;
+}
+
+upstream myapp-stream-dns {
+  server 10.0.0.3:53;
+}
+
+server {
+  listen 5353 udp;
+  proxy_pass myapp-stream-dns;
+}
+
+`
+	if out != expected {
+		t.Fatalf("unexpected stream config:\n%s", out)
+	}
+
+	cfg.Streams = append(cfg.Streams, file_config.StreamConfig{Name: "dns", ProcessType: "dns", Port: 53, Listen: []string{"53"}})
+	if _, err := buildStreamConfig("myapp", cfg, data); err == nil {
+		t.Fatalf("expected error for duplicate stream")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// tlsExpiryWarningPeriod is how long before expiry a certificate is reported
+// as expiring soon.
+const tlsExpiryWarningPeriod = 30 * 24 * time.Hour
+
+// resolveTlsCertificate returns the certificate and key files of a vhost,
+// falling back to the ones installed with the certs plugin.
+func resolveTlsCertificate(tlsCfg *file_config.TlsConfig, certsDir string) (string, string, error) {
+	if tlsCfg.Certificate != "" {
+		return tlsCfg.Certificate, tlsCfg.Key, nil
+	}
+	if certsDir == "" {
+		return "", "", fmt.Errorf("no certificate configured and the certs plugin directory is unknown")
+	}
+	return path.Join(certsDir, "server.crt"), path.Join(certsDir, "server.key"), nil
+}
+
+// checkTlsCertificate checks that the key matches the certificate and reports
+// its expiry date. An expired certificate is only reported, so the app keeps
+// being served while it is renewed.
+func checkTlsCertificate(serverName string, certFile string, keyFile string, now time.Time) (*x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s with key %s: %w", certFile, keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s: %w", certFile, err)
+	}
+
+	switch {
+	case now.After(leaf.NotAfter):
+		log.Printf("[error] certificate %s for %s expired on %s\n", certFile, serverName, leaf.NotAfter.Format(time.RFC3339))
+	case leaf.NotAfter.Sub(now) < tlsExpiryWarningPeriod:
+		log.Printf("[warn] certificate %s for %s expires soon, on %s\n", certFile, serverName, leaf.NotAfter.Format(time.RFC3339))
+	default:
+		log.Printf("[info] certificate %s for %s expires on %s\n", certFile, serverName, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if err := leaf.VerifyHostname(serverName); err != nil {
+		log.Printf("[warn] certificate %s does not cover %s: %v\n", certFile, serverName, err)
+	}
+
+	return leaf, nil
+}
+
+// buildTlsLines renders the ssl_* directives of a vhost.
+func buildTlsLines(serverName string, tlsCfg *file_config.TlsConfig, certsDir string, now time.Time) ([]string, error) {
+	certFile, keyFile, err := resolveTlsCertificate(tlsCfg, certsDir)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := checkTlsCertificate(serverName, certFile, keyFile, now)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{
+		fmt.Sprintf("ssl_certificate %s;", certFile),
+		fmt.Sprintf("ssl_certificate_key %s;", keyFile),
+	}
+	if len(tlsCfg.Protocols) > 0 {
+		lines = append(lines, fmt.Sprintf("ssl_protocols %s;", strings.Join(tlsCfg.Protocols, " ")))
+	}
+	if tlsCfg.Ciphers != "" {
+		lines = append(lines, fmt.Sprintf("ssl_ciphers %s;", tlsCfg.Ciphers))
+	}
+	if tlsCfg.SessionCache != "" {
+		lines = append(lines, fmt.Sprintf("ssl_session_cache %s;", tlsCfg.SessionCache))
+	}
+	if tlsCfg.OcspStapling {
+		if len(leaf.OCSPServer) == 0 {
+			log.Printf("[warn] certificate %s has no OCSP responder, ocsp_stapling will have no effect\n", certFile)
+		}
+		lines = append(lines, "ssl_stapling on;", "ssl_stapling_verify on;")
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func writeTestCertificate(t *testing.T, dir string, name string, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestBuildTlsLines(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "custom", now.Add(90*24*time.Hour))
+	_, otherKeyFile := writeTestCertificate(t, dir, "other", now.Add(90*24*time.Hour))
+	expiredCertFile, expiredKeyFile := writeTestCertificate(t, dir, "expired", now.Add(-time.Hour))
+
+	t.Run("Directives", func(t *testing.T) {
+		lines, err := buildTlsLines("example.com", &file_config.TlsConfig{
+			Certificate:  certFile,
+			Key:          keyFile,
+			Protocols:    []string{"TLSv1.2", "TLSv1.3"},
+			Ciphers:      "HIGH:!aNULL",
+			SessionCache: "shared:SSL:10m",
+			OcspStapling: true,
+		}, "", now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []string{
+			"ssl_certificate " + certFile + ";",
+			"ssl_certificate_key " + keyFile + ";",
+			"ssl_protocols TLSv1.2 TLSv1.3;",
+			"ssl_ciphers HIGH:!aNULL;",
+			"ssl_session_cache shared:SSL:10m;",
+			"ssl_stapling on;",
+			"ssl_stapling_verify on;",
+		}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("unexpected tls lines: %v", lines)
+		}
+	})
+
+	t.Run("CertsPluginCertificate", func(t *testing.T) {
+		certsDir := t.TempDir()
+		writeTestCertificate(t, certsDir, "server", now.Add(90*24*time.Hour))
+		lines, err := buildTlsLines("example.com", &file_config.TlsConfig{}, certsDir, now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if lines[0] != "ssl_certificate "+filepath.Join(certsDir, "server.crt")+";" {
+			t.Errorf("expected certs plugin certificate, got: %v", lines)
+		}
+	})
+
+	t.Run("MismatchedKey", func(t *testing.T) {
+		if _, err := buildTlsLines("example.com", &file_config.TlsConfig{Certificate: certFile, Key: otherKeyFile}, "", now); err == nil {
+			t.Errorf("expected error for mismatched key")
+		}
+	})
+
+	t.Run("ExpiredCertificate", func(t *testing.T) {
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		lines, err := buildTlsLines("example.com", &file_config.TlsConfig{Certificate: expiredCertFile, Key: expiredKeyFile}, "", now)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("expected an expired certificate not to fail the build, got: %v", err)
+		}
+		if lines[0] != "ssl_certificate "+expiredCertFile+";" {
+			t.Errorf("expected the expired certificate to be kept, got: %v", lines)
+		}
+		if !strings.Contains(logs.String(), "[error] certificate "+expiredCertFile+" for example.com expired on ") {
+			t.Errorf("expected the expiry to be logged as an error, got: %s", logs.String())
+		}
+	})
+
+	t.Run("NoCertificate", func(t *testing.T) {
+		if _, err := buildTlsLines("example.com", &file_config.TlsConfig{}, "", now); err == nil {
+			t.Errorf("expected error without certificate")
+		}
+	})
+}
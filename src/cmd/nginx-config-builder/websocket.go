@@ -0,0 +1,108 @@
+package main
+
+import (
+	"dokku-nginx-custom/src/pkg/file_config"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const websocketDefaultTimeout = "3600s"
+
+var websocketDirectivesRegexp = regexp.MustCompile(`(?i)(proxy_http_version|proxy_read_timeout|proxy_send_timeout|proxy_set_header\s+(Upgrade|Connection))\s`)
+
+var connectionHeaderFromClientRegexp = regexp.MustCompile(`(?i)proxy_set_header\s+Connection\s+("?upgrade"?|\$http_connection)\s*;`)
+
+func websocketConnectionVariable(appName string) string {
+	return nginxVariableName(appName, "connection_upgrade")
+}
+
+func usesWebsocket(config *file_config.Config) bool {
+	for _, vhost := range config.Vhosts {
+		for _, location := range vhost.Locations {
+			if location.Websocket {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildWebsocketMapConfig renders the Connection header map of websocket
+// locations. Requests without Upgrade get an empty Connection header rather
+// than `close`, so keepalive upstreams keep their connections open.
+func buildWebsocketMapConfig(appName string, config *file_config.Config) string {
+	if !usesWebsocket(config) {
+		return ""
+	}
+	return fmt.Sprintf(`map $http_upgrade $%s {
+  default upgrade;
+  '' "";
+}
+`, websocketConnectionVariable(appName))
+}
+
+// buildWebsocketLines renders the upgrade headers and timeouts of a websocket
+// location, which the body must not set again.
+func buildWebsocketLines(appName string, location file_config.LocationConfig, body string) ([]string, error) {
+	if match := websocketDirectivesRegexp.FindString(body); match != "" {
+		return nil, fmt.Errorf("websocket: true already sets %q, remove it from the body", strings.TrimSpace(match))
+	}
+	timeout := location.WebsocketTimeout
+	if timeout == "" {
+		timeout = websocketDefaultTimeout
+	}
+	return []string{
+		"proxy_http_version 1.1;",
+		"proxy_set_header Upgrade $http_upgrade;",
+		fmt.Sprintf("proxy_set_header Connection $%s;", websocketConnectionVariable(appName)),
+		fmt.Sprintf("proxy_read_timeout %s;", timeout),
+		fmt.Sprintf("proxy_send_timeout %s;", timeout),
+	}, nil
+}
+
+// keepaliveUpstreams returns the generated names of upstreams with a
+// keepalive directive.
+func keepaliveUpstreams(appName string, config *file_config.Config, upstreams upstreamResultingNames) []string {
+	hasKeepalive := func(directives []string) bool {
+		for _, d := range directives {
+			if strings.HasPrefix(strings.TrimSpace(d), "keepalive ") {
+				return true
+			}
+		}
+		return false
+	}
+
+	names := make([]string, 0)
+	for _, upstream := range config.Upstreams {
+		if upstream.Name != "" && hasKeepalive(upstream.Directives) {
+			names = append(names, fmt.Sprintf("%s-%s", appName, upstream.Name))
+		}
+	}
+	for _, override := range config.UpstreamOverrides {
+		if !hasKeepalive(override.Directives) {
+			continue
+		}
+		if name, ok := upstreams[fmt.Sprintf("%s-%s", override.SelectProcessType, override.SelectPort)]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// warnKeepaliveWithoutWebsocket warns about locations forwarding the client
+// Connection header to a keepalive upstream, which either breaks upgrades or
+// closes the upstream connections.
+func warnKeepaliveWithoutWebsocket(serverName string, locationIndex int, body string, keepaliveNames []string) {
+	if !connectionHeaderFromClientRegexp.MatchString(body) {
+		return
+	}
+	for _, name := range keepaliveNames {
+		re := regexp.MustCompile(`proxy_pass\s+https?://` + regexp.QuoteMeta(name) + `(?:[/;\s]|$)`)
+		if re.MatchString(body) {
+			log.Printf("[warn] vhost %s: location #%d forwards the client Connection header to keepalive upstream %s, use websocket: true instead\n", serverName, locationIndex, name)
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+func TestBuildLocationConfig_Websocket(t *testing.T) {
+	newConfig := func() *file_config.Config {
+		return &file_config.Config{
+			UserVars: file_config.ConfigVars{},
+			SysVars:  file_config.ConfigVars{},
+			Upstreams: []file_config.UpstreamConfig{
+				{Name: "ws", Directives: []string{"keepalive 32"}},
+			},
+			Vhosts: []file_config.VhostConfig{
+				{
+					ServerName: "example.com",
+					Locations: []file_config.LocationConfig{
+						{Uri: "/ws/", Websocket: true, WebsocketTimeout: "1h", Body: "proxy_pass http://{{ .upstreams.ws }};"},
+						{Uri: "/legacy/", Body: "proxy_pass http://{{ .upstreams.ws }};\nproxy_set_header Connection $http_connection;"},
+					},
+				},
+			},
+		}
+	}
+	data := &locationConfigData{upstreams: upstreamResultingNames{"ws": "my-app-ws"}}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	locationConfigs, _, err := buildLocationConfig("my-app", newConfig(), data)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ws := nginxBlock(locationConfigs["example.com"], "location /ws/")
+
+	t.Run("UpgradeHeaders", func(t *testing.T) {
+		for _, directive := range []string{
+			"proxy_http_version 1.1;",
+			"proxy_set_header Upgrade $http_upgrade;",
+			"proxy_set_header Connection $my_app_connection_upgrade;",
+		} {
+			if !strings.Contains(ws, directive) {
+				t.Errorf("expected %q, got: %s", directive, ws)
+			}
+		}
+	})
+
+	t.Run("Timeouts", func(t *testing.T) {
+		for _, directive := range []string{"proxy_read_timeout 1h;", "proxy_send_timeout 1h;"} {
+			if !strings.Contains(ws, directive) {
+				t.Errorf("expected %q, got: %s", directive, ws)
+			}
+		}
+	})
+
+	t.Run("ConnectionMap", func(t *testing.T) {
+		block := nginxBlock(buildWebsocketMapConfig("my-app", newConfig()), "map $http_upgrade $my_app_connection_upgrade")
+		for _, entry := range []string{"default upgrade;", `'' "";`} {
+			if !strings.Contains(block, entry) {
+				t.Errorf("expected %q in the connection map, got: %s", entry, block)
+			}
+		}
+	})
+
+	t.Run("KeepaliveWarning", func(t *testing.T) {
+		if !strings.Contains(logs.String(), "location #1 forwards the client Connection header to keepalive upstream my-app-ws") {
+			t.Errorf("expected keepalive warning, got: %s", logs.String())
+		}
+		if strings.Contains(logs.String(), "location #0") {
+			t.Errorf("unexpected warning for websocket location: %s", logs.String())
+		}
+	})
+
+	t.Run("DuplicateDirective", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Vhosts[0].Locations[0].Body += "\nproxy_read_timeout 60s;"
+		if _, _, err := buildLocationConfig("my-app", cfg, data); err == nil || !strings.Contains(err.Error(), "proxy_read_timeout") {
+			t.Errorf("expected duplicate directive error, got: %v", err)
+		}
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"slices"
 	"strings"
 
 	"github.com/go-playground/validator/v10"
@@ -116,6 +117,7 @@ type UpstreamConfig struct {
 	Servers    []UpstreamServer     `yaml:"servers" validate:"required_if=Name true,excluded_with=select_process_type" json:"servers"`
 	Directives []string             `yaml:"directives" validate:"omitempty" json:"directives"`
 	Zone       NullableUpstreamZone `yaml:"zone" validate:"omitempty" json:"zone"`
+	Protocol   string               `yaml:"protocol" validate:"omitempty,oneof=http grpc grpcs" json:"protocol"`
 }
 
 func (u *UpstreamConfig) UnmarshalYAML(node *yaml.Node) error {
@@ -152,11 +154,173 @@ func (u *UpstreamConfig) UnmarshalYAML(node *yaml.Node) error {
 	return nil
 }
 
+// AuthBasicConfig protects a vhost or location with HTTP basic auth. Users are
+// read from either a Dokku property or a file on the host (outside the image),
+// one `user:password` entry per line; the password is everything after the
+// first colon, commas included. Lines starting with # are ignored. Plain
+// passwords are hashed by the builder; already hashed htpasswd entries are
+// kept as-is.
+type AuthBasicConfig struct {
+	Realm         string `yaml:"realm" validate:"omitempty" json:"realm"`
+	UsersProperty string `yaml:"users_property" validate:"required_without=UsersFile,excluded_with=UsersFile" json:"users_property"`
+	UsersFile     string `yaml:"users_file" validate:"required_without=UsersProperty,excluded_with=UsersProperty" json:"users_file"`
+}
+
+// AuthRequestConfig delegates authorization of a location to a subrequest sent
+// to one of the app upstreams. Headers listed in PassHeaders are copied from the
+// auth response into $<app>_auth_<header> variables, and passed upstream with
+// grpc_set_header for grpc, fastcgi_param HTTP_<HEADER> when the body uses
+// fastcgi_pass, and proxy_set_header otherwise. nginx only inherits these
+// directives from the server block into locations that set none of them, so
+// the body must repeat the ones it relies on, like Host or X-Forwarded-For.
+type AuthRequestConfig struct {
+	Upstream    string   `yaml:"upstream" validate:"required" json:"upstream"`
+	Path        string   `yaml:"path" validate:"required,startswith=/" json:"path"`
+	PassHeaders []string `yaml:"pass_headers" validate:"omitempty,dive,required" json:"pass_headers"`
+}
+
+// CorsConfig describes a CORS policy. Allowed origins are given as exact values
+// ("*" allows any origin) and/or a regular expression matched against the
+// Origin request header. "*" can't be combined with credentials, which need
+// the allowed origins listed.
+type CorsConfig struct {
+	Origins       []string `yaml:"origins" validate:"required_without=OriginRegex,dive,required" json:"origins"`
+	OriginRegex   string   `yaml:"origin_regex" validate:"required_without=Origins" json:"origin_regex"`
+	Methods       []string `yaml:"methods" validate:"omitempty,dive,required" json:"methods"`
+	Headers       []string `yaml:"headers" validate:"omitempty,dive,required" json:"headers"`
+	ExposeHeaders []string `yaml:"expose_headers" validate:"omitempty,dive,required" json:"expose_headers"`
+	Credentials   bool     `yaml:"credentials" json:"credentials"`
+	MaxAge        int      `yaml:"max_age" validate:"omitempty,min=0" json:"max_age"`
+}
+
+type HstsConfig struct {
+	// Defaults to one year when unset.
+	MaxAge            int  `yaml:"max_age" validate:"omitempty,min=0" json:"max_age"`
+	IncludeSubdomains bool `yaml:"include_subdomains" json:"include_subdomains"`
+	Preload           bool `yaml:"preload" json:"preload"`
+}
+
+type CspConfig struct {
+	Policy     string `yaml:"policy" validate:"required" json:"policy"`
+	ReportOnly bool   `yaml:"report_only" json:"report_only"`
+}
+
+// SecurityHeadersConfig lists the security response headers sent by a vhost.
+type SecurityHeadersConfig struct {
+	Hsts              *HstsConfig `yaml:"hsts" validate:"omitempty" json:"hsts"`
+	Csp               *CspConfig  `yaml:"csp" validate:"omitempty" json:"csp"`
+	FrameOptions      string      `yaml:"frame_options" validate:"omitempty,oneof=DENY SAMEORIGIN" json:"frame_options"`
+	ReferrerPolicy    string      `yaml:"referrer_policy" validate:"omitempty,oneof=no-referrer no-referrer-when-downgrade origin origin-when-cross-origin same-origin strict-origin strict-origin-when-cross-origin unsafe-url" json:"referrer_policy"`
+	PermissionsPolicy string      `yaml:"permissions_policy" validate:"omitempty" json:"permissions_policy"`
+}
+
+// TlsConfig sets the TLS settings of a vhost. Without Certificate and Key, the
+// certificate installed with the Dokku certs plugin for the app is used.
+type TlsConfig struct {
+	Certificate  string   `yaml:"certificate" validate:"required_with=Key,omitempty,startswith=/" json:"certificate"`
+	Key          string   `yaml:"key" validate:"required_with=Certificate,omitempty,startswith=/" json:"key"`
+	Protocols    []string `yaml:"protocols" validate:"omitempty,dive,oneof=TLSv1 TLSv1.1 TLSv1.2 TLSv1.3" json:"protocols"`
+	Ciphers      string   `yaml:"ciphers" validate:"omitempty" json:"ciphers"`
+	SessionCache string   `yaml:"session_cache" validate:"omitempty" json:"session_cache"`
+	OcspStapling bool     `yaml:"ocsp_stapling" json:"ocsp_stapling"`
+}
+
+// Http3Config enables HTTP/3 (QUIC) on a vhost. Listen defaults to 443 on
+// IPv4 and IPv6.
+type Http3Config struct {
+	Listen       []string `yaml:"listen" validate:"omitempty,dive,required" json:"listen"`
+	AltSvcMaxAge int      `yaml:"alt_svc_max_age" validate:"omitempty,min=0" json:"alt_svc_max_age"`
+}
+
+// AccessConfig restricts a vhost or location to client addresses. Rules are
+// checked in order and the first one matching the client applies, as in nginx.
+// Default closes the list, deny when a rule allows addresses and allow
+// otherwise.
+type AccessConfig struct {
+	Rules   []AccessRuleConfig `yaml:"rules" validate:"omitempty,dive" json:"rules"`
+	Default string             `yaml:"default" validate:"omitempty,oneof=allow deny" json:"default"`
+}
+
+// AccessRuleConfig allows or denies an IP or CIDR, `list:<name>` to reference a
+// named access list (from access_lists or the global access-list-<name>
+// property), or `file:<path>` to read entries from a file in the app image.
+type AccessRuleConfig struct {
+	Allow string `yaml:"allow" validate:"required_without=Deny,excluded_with=Deny" json:"allow"`
+	Deny  string `yaml:"deny" validate:"required_without=Allow,excluded_with=Allow" json:"deny"`
+}
+
+type AccessListConfig struct {
+	Name    string   `yaml:"name" validate:"required" json:"name"`
+	Entries []string `yaml:"entries" validate:"required,dive,required" json:"entries"`
+}
+
+// RedirectConfig is a declarative redirect rule. Match defaults to exact; with
+// prefix the matched prefix of the URI is replaced by To.
+type RedirectConfig struct {
+	From          string `yaml:"from" validate:"required" json:"from"`
+	To            string `yaml:"to" validate:"required" json:"to"`
+	Code          int    `yaml:"code" validate:"omitempty,oneof=301 302 303 307 308" json:"code"`
+	Match         string `yaml:"match" validate:"omitempty,oneof=exact prefix regex" json:"match"`
+	PreserveQuery bool   `yaml:"preserve_query" json:"preserve_query"`
+}
+
+// StaticConfig serves files straight from a container mount (Mount is the
+// mount destination, Path an optional sub directory) or from the container
+// filesystem (Path, relative to the image working directory).
+type StaticConfig struct {
+	Mount string `yaml:"mount" validate:"omitempty" json:"mount"`
+	Path  string `yaml:"path" validate:"required_without=Mount" json:"path"`
+	// Alias uses `alias` instead of `root`, for locations whose uri isn't part of the file path.
+	Alias bool `yaml:"alias" json:"alias"`
+	// Fallback is the upstream requests are passed to when no file matches.
+	Fallback string `yaml:"fallback" validate:"omitempty" json:"fallback"`
+	// Expires maps file extensions (and "default") to an `expires` value.
+	Expires    map[string]string `yaml:"expires" validate:"omitempty" json:"expires"`
+	GzipStatic bool              `yaml:"gzip_static" json:"gzip_static"`
+}
+
+// ErrorPageConfig maps status codes to an HTML page taken from the app image,
+// either as-is (File) or rendered as a sigil template (Template) with Vars.
+type ErrorPageConfig struct {
+	Codes    []int          `yaml:"codes" validate:"required,dive,min=300,max=599" json:"codes"`
+	File     string         `yaml:"file" validate:"required_without=Template,excluded_with=Template" json:"file"`
+	Template string         `yaml:"template" validate:"required_without=File,excluded_with=File" json:"template"`
+	Vars     map[string]any `yaml:"vars" validate:"omitempty" json:"vars"`
+}
+
+// GrpcConfig proxies a location to an upstream with protocol grpc or grpcs.
+type GrpcConfig struct {
+	Upstream       string `yaml:"upstream" validate:"required" json:"upstream"`
+	ConnectTimeout string `yaml:"connect_timeout" validate:"omitempty" json:"connect_timeout"`
+	ReadTimeout    string `yaml:"read_timeout" validate:"omitempty" json:"read_timeout"`
+	SendTimeout    string `yaml:"send_timeout" validate:"omitempty" json:"send_timeout"`
+}
+
+// MirrorConfig copies a sample of the requests of a location to another
+// upstream. Percent defaults to 100 and responses of the mirror are ignored.
+type MirrorConfig struct {
+	Upstream string  `yaml:"upstream" validate:"required" json:"upstream"`
+	Percent  float64 `yaml:"percent" validate:"omitempty,gt=0,lte=100" json:"percent"`
+	Body     bool    `yaml:"body" json:"body"`
+}
+
 type LocationConfig struct {
 	Modifier string `yaml:"modifier" validate:"omitempty,excluded_without=Uri" json:"modifier"`
 	Uri      string `yaml:"uri" validate:"excluded_with=Named" json:"uri"`
 	Named    string `yaml:"named" validate:"excluded_with=Uri,excluded_with=Modifier" json:"named"`
-	Body     string `yaml:"body" validate:"required" json:"body"`
+	Body     string `yaml:"body" validate:"required_without_all=Static Grpc" json:"body"`
+
+	AuthBasic   *AuthBasicConfig   `yaml:"auth_basic" validate:"omitempty" json:"auth_basic"`
+	AuthRequest *AuthRequestConfig `yaml:"auth_request" validate:"omitempty" json:"auth_request"`
+	Cors        *CorsConfig        `yaml:"cors" validate:"omitempty" json:"cors"`
+	Access      *AccessConfig      `yaml:"access" validate:"omitempty" json:"access"`
+	Static      *StaticConfig      `yaml:"static" validate:"omitempty" json:"static"`
+	Grpc        *GrpcConfig        `yaml:"grpc" validate:"omitempty" json:"grpc"`
+	Mirror      *MirrorConfig      `yaml:"mirror" validate:"omitempty" json:"mirror"`
+
+	// Websocket adds the upgrade headers and long timeouts to a proxied location.
+	Websocket        bool   `yaml:"websocket" json:"websocket"`
+	WebsocketTimeout string `yaml:"websocket_timeout" validate:"omitempty,excluded_without=Websocket" json:"websocket_timeout"`
 }
 
 type MapConfig struct {
@@ -177,7 +341,51 @@ type CacheConfig struct {
 	Flags         map[string]string `json:"flags" yaml:"flags"`
 	InMem         bool              `yaml:"in_mem" json:"in_mem" validate:"excluded_if=OnDisk true"`
 	OnDisk        bool              `yaml:"on_disk" json:"on_disk" validate:"excluded_if=InMem true"`
-	PurgeOnDeploy bool              `yaml:"purge_on_deploy" json:"purge_on_deploy"`
+	PurgeOnDeploy PurgeOnDeploy     `yaml:"purge_on_deploy" json:"purge_on_deploy"`
+	WarmOnDeploy  *CacheWarmConfig  `yaml:"warm_on_deploy" validate:"omitempty" json:"warm_on_deploy"`
+}
+
+// PurgeOnDeploy is set with true, false or "on_change", which only purges the
+// cache when its key or flags changed since it was last purged.
+type PurgeOnDeploy string
+
+const (
+	PurgeOnDeployNever    PurgeOnDeploy = ""
+	PurgeOnDeployAlways   PurgeOnDeploy = "always"
+	PurgeOnDeployOnChange PurgeOnDeploy = "on_change"
+)
+
+func (p *PurgeOnDeploy) UnmarshalYAML(node *yaml.Node) error {
+	var enabled bool
+	if err := node.Decode(&enabled); err == nil {
+		*p = PurgeOnDeployNever
+		if enabled {
+			*p = PurgeOnDeployAlways
+		}
+		return nil
+	}
+
+	var mode string
+	if err := node.Decode(&mode); err != nil || PurgeOnDeploy(mode) != PurgeOnDeployOnChange {
+		return fmt.Errorf("line %d: invalid purge_on_deploy %q, expected true, false or on_change", node.Line, node.Value)
+	}
+	*p = PurgeOnDeployOnChange
+	return nil
+}
+
+// CacheWarmConfig lists the pages requested through nginx after a deploy, so
+// the cache is not cold.
+type CacheWarmConfig struct {
+	Paths []string `yaml:"paths" validate:"required_without=Sitemap,omitempty,dive,startswith=/" json:"paths"`
+	// Sitemap is a sitemap.xml in the app image, relative to its working directory.
+	Sitemap string `yaml:"sitemap" validate:"required_without=Paths" json:"sitemap"`
+	// Host defaults to the sitemap URL host, then to the first server name.
+	Host string `yaml:"host" json:"host"`
+	// BaseUrl is the nginx listener requested. By default, pages are requested
+	// on 127.0.0.1 with the scheme of their sitemap URL, else https when the
+	// first vhost has tls settings.
+	BaseUrl     string `yaml:"base_url" validate:"omitempty,url" json:"base_url"`
+	Concurrency int    `yaml:"concurrency" validate:"omitempty,min=1,max=64" json:"concurrency"`
 }
 
 type VhostConfig struct {
@@ -185,11 +393,44 @@ type VhostConfig struct {
 	Locations  []LocationConfig `yaml:"locations" validate:"required,dive" json:"locations"`
 	Variables  []VariableConfig `yaml:"variables" validate:"omitempty,dive" json:"variables"`
 
+	AuthBasic *AuthBasicConfig `yaml:"auth_basic" validate:"omitempty" json:"auth_basic"`
+	// Cors applies to every location of the vhost unless the location sets its own.
+	Cors *CorsConfig `yaml:"cors" validate:"omitempty" json:"cors"`
+
+	SecurityHeaders *SecurityHeadersConfig `yaml:"security_headers" validate:"omitempty" json:"security_headers"`
+	Access          *AccessConfig          `yaml:"access" validate:"omitempty" json:"access"`
+	Tls             *TlsConfig             `yaml:"tls" validate:"omitempty" json:"tls"`
+	Http3           *Http3Config           `yaml:"http3" validate:"omitempty" json:"http3"`
+	// Http2 declares the vhost served over HTTP/2, as grpc locations need. The
+	// server template enables it on the TLS listeners when nginx supports it,
+	// and the build fails when it doesn't.
+	Http2 bool `yaml:"http2" json:"http2"`
+
+	Redirects []RedirectConfig `yaml:"redirects" validate:"omitempty,dive" json:"redirects"`
+	// RedirectsFile is a CSV or YAML file in the app image with more redirect rules.
+	RedirectsFile string `yaml:"redirects_file" validate:"omitempty" json:"redirects_file"`
+
+	ErrorPages []ErrorPageConfig `yaml:"error_pages" validate:"omitempty,dive" json:"error_pages"`
+	// InterceptErrors makes upstream error responses use error_pages too.
+	InterceptErrors bool `yaml:"intercept_errors" json:"intercept_errors"`
+
 	InServerBlock string `yaml:"in_server_block" validate:"omitempty" json:"in_server_block"`
 }
 
 type ConfigVars map[string]any
 
+// StreamConfig proxies a TCP or UDP port of a process type through the nginx
+// stream module.
+type StreamConfig struct {
+	Name               string   `yaml:"name" validate:"required" json:"name"`
+	ProcessType        string   `yaml:"process_type" validate:"required" json:"process_type"`
+	Port               int      `yaml:"port" validate:"required,min=1,max=65535" json:"port"`
+	Listen             []string `yaml:"listen" validate:"required,dive,required" json:"listen"`
+	Protocol           string   `yaml:"protocol" validate:"omitempty,oneof=tcp udp" json:"protocol"`
+	UpstreamDirectives []string `yaml:"upstream_directives" validate:"omitempty" json:"upstream_directives"`
+	Directives         []string `yaml:"directives" validate:"omitempty" json:"directives"`
+}
+
 type Config struct {
 	Vhosts []VhostConfig `yaml:"vhosts" validate:"required,dive"`
 
@@ -202,6 +443,8 @@ type Config struct {
 	Maps                []MapConfig      `yaml:"maps" validate:"omitempty,dive" json:"maps"`
 	ProxyCaches         []CacheConfig    `yaml:"proxy_caches" validate:"omitempty,dive" json:"proxy_caches"`
 	FastcgiCaches       []CacheConfig    `yaml:"fastcgi_caches" validate:"omitempty,dive" json:"fastcgi_caches"`
+	AccessLists         []AccessListConfig `yaml:"access_lists" validate:"omitempty,dive" json:"access_lists"`
+	Streams             []StreamConfig     `yaml:"streams" validate:"omitempty,dive" json:"streams"`
 
 	InHttpBlock string `yaml:"in_http_block" validate:"omitempty" json:"in_http_block"`
 }
@@ -271,6 +514,10 @@ func validateConfig(config *Config) error {
 				msg = fmt.Sprintf("field '%s' is required", err.Field())
 			case "required_without":
 				msg = fmt.Sprintf("field '%s' is required when '%s' is not provided", err.Field(), err.Param())
+			case "required_without_all":
+				msg = fmt.Sprintf("field '%s' is required when none of '%s' are provided", err.Field(), err.Param())
+			case "required_with":
+				msg = fmt.Sprintf("field '%s' is required when '%s' is provided", err.Field(), err.Param())
 			case "excluded_with":
 				msg = fmt.Sprintf("field '%s' cannot be used together with '%s'", err.Field(), err.Param())
 			case "min":
@@ -285,6 +532,33 @@ func validateConfig(config *Config) error {
 		}
 		return fmt.Errorf("validation errors:\n- %s", strings.Join(errorMessages, "\n- "))
 	}
+
+	for _, vhost := range config.Vhosts {
+		if err := ValidateRedirects(vhost.ServerName, vhost.Redirects); err != nil {
+			return err
+		}
+		if err := validateCors(vhost.Cors); err != nil {
+			return fmt.Errorf("vhost %s: %w", vhost.ServerName, err)
+		}
+		for i, location := range vhost.Locations {
+			if err := validateCors(location.Cors); err != nil {
+				return fmt.Errorf("vhost %s: location #%d: %w", vhost.ServerName, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateCors rejects allowing any origin with credentials: browsers refuse
+// "*" with credentials, and reflecting the origin instead would let any site
+// make credentialed requests.
+func validateCors(cors *CorsConfig) error {
+	if cors == nil || !cors.Credentials {
+		return nil
+	}
+	if slices.Contains(cors.Origins, "*") {
+		return errors.New(`cors: origins "*" cannot be used with credentials, list the allowed origins or use origin_regex`)
+	}
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package file_config
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -86,3 +87,107 @@ upstreams:
 		}
 	})
 }
+
+func TestPurgeOnDeploy_Unmarshal(t *testing.T) {
+	config := func(purgeOnDeploy string) []byte {
+		return []byte(`
+vhosts:
+  - server_name: example.com
+    locations:
+      - uri: "/"
+        body: |
+          return 200;
+proxy_caches:
+  - name: pages
+    purge_on_deploy: ` + purgeOnDeploy + `
+`)
+	}
+
+	for value, expected := range map[string]PurgeOnDeploy{
+		"true":      PurgeOnDeployAlways,
+		"false":     PurgeOnDeployNever,
+		"on_change": PurgeOnDeployOnChange,
+	} {
+		cfg, _, err := ReadConfigBytes(config(value))
+		if err != nil {
+			t.Fatalf("purge_on_deploy %s: unexpected error: %v", value, err)
+		}
+		if cfg.ProxyCaches[0].PurgeOnDeploy != expected {
+			t.Errorf("purge_on_deploy %s: expected %q, got %q", value, expected, cfg.ProxyCaches[0].PurgeOnDeploy)
+		}
+	}
+
+	if _, _, err := ReadConfigBytes(config("sometimes")); err == nil {
+		t.Errorf("expected an error for an invalid purge_on_deploy")
+	}
+}
+
+func TestCorsCredentials_Validate(t *testing.T) {
+	config := func(cors string) []byte {
+		return []byte(`
+vhosts:
+  - server_name: example.com
+    locations:
+      - uri: "/"
+        body: |
+          return 200;
+        cors:
+` + cors)
+	}
+
+	t.Run("AnyOriginWithCredentials", func(t *testing.T) {
+		if _, _, err := ReadConfigBytes(config("          origins: [\"*\"]\n          credentials: true\n")); err == nil || !strings.Contains(err.Error(), "cannot be used with credentials") {
+			t.Errorf("expected an error for any origin with credentials, got %v", err)
+		}
+	})
+
+	t.Run("AnyOrigin", func(t *testing.T) {
+		if _, _, err := ReadConfigBytes(config("          origins: [\"*\"]\n")); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ListedOriginsWithCredentials", func(t *testing.T) {
+		if _, _, err := ReadConfigBytes(config("          origins: [\"https://app.example.com\"]\n          credentials: true\n")); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestAccessRules_Validate(t *testing.T) {
+	config := func(rules string) []byte {
+		return []byte(`
+vhosts:
+  - server_name: example.com
+    access:
+      rules:
+` + rules + `    locations:
+      - uri: "/"
+        body: |
+          return 200;
+`)
+	}
+
+	t.Run("Ordered", func(t *testing.T) {
+		cfg, _, err := ReadConfigBytes(config("        - allow: 203.0.113.66\n        - deny: 203.0.113.0/24\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rules := cfg.Vhosts[0].Access.Rules
+		if len(rules) != 2 || rules[0].Allow != "203.0.113.66" || rules[1].Deny != "203.0.113.0/24" {
+			t.Errorf("expected the rules in order, got %+v", rules)
+		}
+	})
+
+	t.Run("AllowAndDeny", func(t *testing.T) {
+		if _, _, err := ReadConfigBytes(config("        - allow: 10.0.0.1\n          deny: 10.0.0.2\n")); err == nil {
+			t.Errorf("expected an error for a rule both allowing and denying")
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, _, err := ReadConfigBytes(config("        - {}\n")); err == nil {
+			t.Errorf("expected an error for an empty rule")
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package file_config
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseRedirects reads redirect rules from a YAML list or a CSV file with the
+// columns from,to[,code[,match[,preserve_query]]]. The format is chosen by the
+// file extension.
+func ParseRedirects(filename string, data []byte) ([]RedirectConfig, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		var redirects []RedirectConfig
+		if err := yaml.Unmarshal(data, &redirects); err != nil {
+			return nil, fmt.Errorf("failed to parse redirects file %s: %w", filename, err)
+		}
+		return redirects, nil
+	case ".csv":
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comment = '#'
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse redirects file %s: %w", filename, err)
+		}
+
+		redirects := make([]RedirectConfig, 0, len(records))
+		for i, record := range records {
+			if i == 0 && strings.EqualFold(record[0], "from") {
+				continue
+			}
+			if len(record) < 2 || len(record) > 5 {
+				return nil, fmt.Errorf("redirects file %s line %d: expected 2 to 5 columns, got %d", filename, i+1, len(record))
+			}
+			redirect := RedirectConfig{From: record[0], To: record[1]}
+			if len(record) > 2 && record[2] != "" {
+				if redirect.Code, err = strconv.Atoi(record[2]); err != nil {
+					return nil, fmt.Errorf("redirects file %s line %d: invalid code %q", filename, i+1, record[2])
+				}
+			}
+			if len(record) > 3 {
+				redirect.Match = record[3]
+			}
+			if len(record) > 4 && record[4] != "" {
+				if redirect.PreserveQuery, err = strconv.ParseBool(record[4]); err != nil {
+					return nil, fmt.Errorf("redirects file %s line %d: invalid preserve_query %q", filename, i+1, record[4])
+				}
+			}
+			redirects = append(redirects, redirect)
+		}
+		return redirects, nil
+	default:
+		return nil, fmt.Errorf("unsupported redirects file %s: expected .csv, .yaml or .yml", filename)
+	}
+}
+
+// redirectTargetPath returns the local path a redirect target points to, or ""
+// when it leaves the vhost.
+func redirectTargetPath(serverName string, to string) string {
+	if strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "//") {
+		to, _, _ = strings.Cut(to, "?")
+		return to
+	}
+	u, err := url.Parse(to)
+	if err != nil || u.Hostname() != serverName {
+		return ""
+	}
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// ValidateRedirects checks redirect rules for invalid values, duplicates and
+// redirect loops. Regex rules are only checked for duplicates.
+func ValidateRedirects(serverName string, redirects []RedirectConfig) error {
+	exact := make(map[string]string)
+	prefixes := make(map[string]string)
+	seen := make(map[string]bool)
+
+	for i, redirect := range redirects {
+		match := redirect.Match
+		if match == "" {
+			match = "exact"
+		}
+		switch match {
+		case "exact", "prefix":
+			if !strings.HasPrefix(redirect.From, "/") {
+				return fmt.Errorf("vhost %s: redirect #%d: from %q must start with /", serverName, i, redirect.From)
+			}
+		case "regex":
+		default:
+			return fmt.Errorf("vhost %s: redirect #%d: invalid match %q", serverName, i, redirect.Match)
+		}
+		switch redirect.Code {
+		case 0, 301, 302, 303, 307, 308:
+		default:
+			return fmt.Errorf("vhost %s: redirect #%d: invalid code %d", serverName, i, redirect.Code)
+		}
+
+		key := match + " " + redirect.From
+		if seen[key] {
+			return fmt.Errorf("vhost %s: duplicate %s redirect from %q", serverName, match, redirect.From)
+		}
+		seen[key] = true
+
+		switch match {
+		case "exact":
+			exact[redirect.From] = redirect.To
+		case "prefix":
+			prefixes[redirect.From] = redirect.To
+		}
+	}
+
+	resolve := func(p string) (string, bool) {
+		if to, ok := exact[p]; ok {
+			return redirectTargetPath(serverName, to), true
+		}
+		longest := ""
+		for from := range prefixes {
+			if strings.HasPrefix(p, from) && len(from) > len(longest) {
+				longest = from
+			}
+		}
+		if longest == "" {
+			return "", false
+		}
+		target := redirectTargetPath(serverName, prefixes[longest])
+		if target == "" {
+			return "", true
+		}
+		return target + strings.TrimPrefix(p, longest), true
+	}
+
+	for _, redirect := range redirects {
+		if redirect.Match == "regex" {
+			continue
+		}
+		chain := []string{redirect.From}
+		visited := map[string]bool{redirect.From: true}
+		p := redirect.From
+		for {
+			next, ok := resolve(p)
+			if !ok || next == "" {
+				break
+			}
+			chain = append(chain, next)
+			if visited[next] || len(chain) > len(redirects)+1 {
+				return fmt.Errorf("vhost %s: redirect loop detected: %s", serverName, strings.Join(chain, " -> "))
+			}
+			visited[next] = true
+			p = next
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package file_config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRedirects(t *testing.T) {
+	t.Run("CSV", func(t *testing.T) {
+		redirects, err := ParseRedirects("redirects.csv", []byte(`from,to,code,match,preserve_query
+# vanity URLs
+/promo,/campaigns/summer,302
+/docs/,https://docs.example.com/,308,prefix,true
+`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(redirects) != 2 {
+			t.Fatalf("expected 2 redirects, got %d", len(redirects))
+		}
+		if redirects[0] != (RedirectConfig{From: "/promo", To: "/campaigns/summer", Code: 302}) {
+			t.Fatalf("unexpected first redirect: %+v", redirects[0])
+		}
+		if redirects[1] != (RedirectConfig{From: "/docs/", To: "https://docs.example.com/", Code: 308, Match: "prefix", PreserveQuery: true}) {
+			t.Fatalf("unexpected second redirect: %+v", redirects[1])
+		}
+	})
+
+	t.Run("YAML", func(t *testing.T) {
+		redirects, err := ParseRedirects("redirects.yml", []byte(`
+- from: /old
+  to: /new
+  preserve_query: true
+`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(redirects) != 1 || redirects[0].To != "/new" || !redirects[0].PreserveQuery {
+			t.Fatalf("unexpected redirects: %+v", redirects)
+		}
+	})
+
+	t.Run("UnsupportedExtension", func(t *testing.T) {
+		if _, err := ParseRedirects("redirects.txt", nil); err == nil {
+			t.Fatalf("expected error for unsupported extension")
+		}
+	})
+}
+
+func TestValidateRedirects(t *testing.T) {
+	cases := []struct {
+		name      string
+		redirects []RedirectConfig
+		wantErr   string
+	}{
+		{
+			name: "Valid",
+			redirects: []RedirectConfig{
+				{From: "/a", To: "/b"},
+				{From: "/old/", To: "/new/", Match: "prefix"},
+				{From: "/c", To: "https://other.example.com/c"},
+			},
+		},
+		{
+			name:      "Duplicate",
+			redirects: []RedirectConfig{{From: "/a", To: "/b"}, {From: "/a", To: "/c", Match: "exact"}},
+			wantErr:   "duplicate",
+		},
+		{
+			name:      "Loop",
+			redirects: []RedirectConfig{{From: "/a", To: "/b"}, {From: "/b", To: "https://example.com/a?x=1"}},
+			wantErr:   "loop",
+		},
+		{
+			name:      "PrefixLoop",
+			redirects: []RedirectConfig{{From: "/blog", To: "/blog/", Match: "prefix"}},
+			wantErr:   "loop",
+		},
+		{
+			name:      "RelativeFrom",
+			redirects: []RedirectConfig{{From: "a", To: "/b"}},
+			wantErr:   "must start with /",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateRedirects("example.com", tc.redirects)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package nginx_cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFile is written by the config builder in every release.
+const ManifestFile = "cache_fingerprints.json"
+
+// PurgedManifestFile records, in the app data directory, the fingerprints the
+// caches were last purged at.
+const PurgedManifestFile = "cache_fingerprints.purged.json"
+
+// Manifest holds the fingerprint of the key and flags of every cache, by kind
+// and cache name.
+type Manifest map[string]map[string]string
+
+// ReadManifest returns the manifest at path, or nil if there is none.
+func ReadManifest(path string) (Manifest, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache manifest: %w", err)
+	}
+	manifest := make(Manifest)
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse cache manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// WriteManifest replaces the manifest at path atomically.
+func WriteManifest(path string, manifest Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache manifest: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache manifest: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache manifest: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write cache manifest: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ChangedCaches returns the caches among names whose fingerprint in current
+// differs from the one they were last purged at. Caches never purged, or
+// missing from current, are returned too: their entries may be stale.
+func ChangedCaches(current Manifest, purged Manifest, kind string, names []string) []string {
+	changed := make([]string, 0)
+	for _, name := range names {
+		fingerprint, ok := current[kind][name]
+		if !ok || fingerprint != purged[kind][name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// RecordPurge records that the cache was purged at its current fingerprint.
+func (m Manifest) RecordPurge(current Manifest, kind string, name string) {
+	fingerprint, ok := current[kind][name]
+	if !ok {
+		// unknown, so the next deploy purges it again
+		delete(m[kind], name)
+		return
+	}
+	if m[kind] == nil {
+		m[kind] = make(map[string]string)
+	}
+	m[kind][name] = fingerprint
+}
@@ -0,0 +1,280 @@
+// Reads the cache files nginx writes for proxy_cache_path and fastcgi_cache_path
+
+package nginx_cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+// Version is the cache file format nginx writes since 1.7.8
+// (NGX_HTTP_CACHE_VERSION).
+const Version = 5
+
+// HeaderSize is the size of ngx_http_file_cache_header_t on 64-bit platforms,
+// which the KEY line follows.
+const HeaderSize = 160
+
+const (
+	etagLen    = 42
+	varyLen    = 42
+	variantLen = 16
+)
+
+// maxHeadSize bounds how much of a cache file is read to parse the key and the
+// stored headers; header_start and body_start are 16-bit offsets.
+const maxHeadSize = 1 << 16
+
+var keyPrefix = []byte("\nKEY: ")
+
+var entryNameRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Entry is a cached response.
+type Entry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+
+	Key          string    `json:"key"`
+	ValidSec     time.Time `json:"valid_sec"`
+	UpdatingSec  int64     `json:"updating_sec"`
+	ErrorSec     int64     `json:"error_sec"`
+	LastModified time.Time `json:"last_modified"`
+	Date         time.Time `json:"date"`
+	Etag         string    `json:"etag"`
+	Vary         string    `json:"vary"`
+	HeaderStart  int       `json:"header_start"`
+	BodyStart    int       `json:"body_start"`
+
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers"`
+}
+
+// Expired tells whether nginx considers the entry stale at now.
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.ValidSec.After(now)
+}
+
+func unixTime(sec int64) time.Time {
+	if sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// IsEntryName tells whether a file in a cache directory is a cache entry, as
+// opposed to a temporary file nginx is still writing.
+func IsEntryName(name string) bool {
+	return entryNameRegexp.MatchString(name)
+}
+
+// ParseEntry parses the head of a cache file: the binary header, the KEY line
+// and the stored response headers.
+func ParseEntry(head []byte) (*Entry, error) {
+	if len(head) < HeaderSize {
+		return nil, fmt.Errorf("truncated cache header: %d bytes", len(head))
+	}
+	le := binary.LittleEndian
+	version := le.Uint64(head[0:8])
+	if version != Version {
+		return nil, fmt.Errorf("unsupported cache file version %d", version)
+	}
+
+	entry := &Entry{
+		ValidSec:     unixTime(int64(le.Uint64(head[8:16]))),
+		UpdatingSec:  int64(le.Uint64(head[16:24])),
+		ErrorSec:     int64(le.Uint64(head[24:32])),
+		LastModified: unixTime(int64(le.Uint64(head[32:40]))),
+		Date:         unixTime(int64(le.Uint64(head[40:48]))),
+		HeaderStart:  int(le.Uint16(head[54:56])),
+		BodyStart:    int(le.Uint16(head[56:58])),
+	}
+	etagSize := int(head[58])
+	if etagSize > etagLen {
+		return nil, fmt.Errorf("invalid etag length %d", etagSize)
+	}
+	entry.Etag = string(head[59 : 59+etagSize])
+	varyOffset := 59 + etagLen
+	varySize := int(head[varyOffset])
+	if varySize > varyLen {
+		return nil, fmt.Errorf("invalid vary length %d", varySize)
+	}
+	entry.Vary = string(head[varyOffset+1 : varyOffset+1+varySize])
+
+	if !bytes.HasPrefix(head[HeaderSize:], keyPrefix) {
+		return nil, errors.New("missing KEY line")
+	}
+	keyEnd := bytes.IndexByte(head[HeaderSize+len(keyPrefix):], '\n')
+	if keyEnd < 0 {
+		return nil, errors.New("unterminated KEY line")
+	}
+	entry.Key = string(head[HeaderSize+len(keyPrefix) : HeaderSize+len(keyPrefix)+keyEnd])
+
+	if entry.HeaderStart > entry.BodyStart || entry.BodyStart > len(head) {
+		return nil, fmt.Errorf("invalid header offsets %d-%d", entry.HeaderStart, entry.BodyStart)
+	}
+	status, headers, err := parseHeaders(head[entry.HeaderStart:entry.BodyStart])
+	if err != nil {
+		return nil, err
+	}
+	entry.Status = status
+	entry.Headers = headers
+	return entry, nil
+}
+
+// parseHeaders parses the stored response headers: an HTTP response for proxy
+// caches, or the CGI headers of the first FastCGI record for fastcgi caches.
+func parseHeaders(raw []byte) (int, http.Header, error) {
+	// FCGI_STDOUT record header: version 1, type 6
+	if len(raw) >= 8 && raw[0] == 1 && raw[1] == 6 {
+		raw = raw[8:]
+	}
+
+	status := http.StatusOK
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	if bytes.HasPrefix(raw, []byte("HTTP/")) {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid status line: %w", err)
+		}
+		_, code, _ := strings.Cut(line, " ")
+		code, _, _ = strings.Cut(code, " ")
+		if status, err = strconv.Atoi(code); err != nil {
+			return 0, nil, fmt.Errorf("invalid status line %q", line)
+		}
+	}
+
+	mime, err := reader.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, nil, fmt.Errorf("invalid stored headers: %w", err)
+	}
+	headers := http.Header(mime)
+	if value := headers.Get("Status"); value != "" {
+		code, _, _ := strings.Cut(value, " ")
+		if status, err = strconv.Atoi(code); err != nil {
+			return 0, nil, fmt.Errorf("invalid Status header %q", value)
+		}
+	}
+	return status, headers, nil
+}
+
+// ReadEntry reads the cache file at path.
+func ReadEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, maxHeadSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	entry, err := ParseEntry(head[:n])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	entry.Path = path
+	entry.Size = info.Size()
+	return entry, nil
+}
+
+// WalkEntries calls fn for every entry of the cache at root. Entries that can't
+// be read are passed with their error, so fn decides whether to stop.
+func WalkEntries(root string, fn func(path string, entry *Entry, err error) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return fn(path, nil, err)
+		}
+		if d.IsDir() || !IsEntryName(d.Name()) {
+			return nil
+		}
+		entry, err := ReadEntry(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// evicted by the cache manager meanwhile
+			return nil
+		}
+		return fn(path, entry, err)
+	})
+}
+
+// ParseCacheDefaultFlags parses the proxy-cache-default-flags and
+// fastcgi-cache-default-flags properties, as the config builder does.
+func ParseCacheDefaultFlags(value string) map[string]string {
+	flags := make(map[string]string)
+	for _, flag := range strings.Fields(value) {
+		k, v, _ := strings.Cut(flag, "=")
+		flags[k] = v
+	}
+	return flags
+}
+
+// LoadCacheRoots returns the in_mem and on_disk root directories of the caches
+// of kind, from the environment the plugin runs the cache tools with.
+func LoadCacheRoots(kind string) map[string]string {
+	prefix := "PROXY_CACHE"
+	if kind == "fastcgi" {
+		prefix = "FASTCGI_CACHE"
+	}
+	return map[string]string{
+		"in_mem":  os.Getenv(prefix + "_IN_MEM_ROOT_PATH"),
+		"on_disk": os.Getenv(prefix + "_ON_DISK_ROOT_PATH"),
+	}
+}
+
+// BuildCachePath returns the directory of a cache, as the config builder
+// declares it.
+func BuildCachePath(kind string, appName string, cache file_config.CacheConfig, roots map[string]string) (string, error) {
+	if cache.CachePath != "" {
+		return cache.CachePath, nil
+	}
+
+	if appName == "" {
+		return "", fmt.Errorf("cache %q: app name is required to derive cache path; set -app-name or APP_NAME/DOKKU_APP_NAME", cache.Name)
+	}
+
+	var root string
+	switch {
+	case cache.InMem:
+		root = roots["in_mem"]
+	case cache.OnDisk:
+		root = roots["on_disk"]
+	default:
+		// follow builder default: prefer on_disk when unspecified
+		root = roots["on_disk"]
+	}
+
+	if root == "" {
+		return "", fmt.Errorf("cache %q: missing cache root path for %s caches", cache.Name, kind)
+	}
+
+	prefix := "proxy"
+	if kind == "fastcgi" {
+		prefix = "fastcgi"
+	}
+
+	cacheDirName := fmt.Sprintf("%s_%s_%s", prefix, appName, cache.Name)
+	return filepath.Join(root, cacheDirName), nil
+}
@@ -0,0 +1,159 @@
+package nginx_cache
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dokku-nginx-custom/src/pkg/file_config"
+)
+
+// testEntry builds a cache file as nginx writes it.
+func testEntry(key string, date time.Time, validSec time.Time, headers string, body string) []byte {
+	head := make([]byte, HeaderSize)
+	le := binary.LittleEndian
+	le.PutUint64(head[0:8], Version)
+	le.PutUint64(head[8:16], uint64(validSec.Unix()))
+	le.PutUint64(head[40:48], uint64(date.Unix()))
+	head[58] = byte(len(`"abc"`))
+	copy(head[59:], `"abc"`)
+
+	keyLine := "\nKEY: " + key + "\n"
+	headerStart := HeaderSize + len(keyLine)
+	le.PutUint16(head[54:56], uint16(headerStart))
+	le.PutUint16(head[56:58], uint16(headerStart+len(headers)))
+	return append(append(append(head, keyLine...), headers...), body...)
+}
+
+func TestParseEntry(t *testing.T) {
+	date := time.Unix(1700000000, 0)
+	content := testEntry("httpsexample.com/", date, date.Add(time.Hour), "HTTP/1.1 404 Not Found\r\nContent-Type: text/html; charset=utf-8\r\nCache-Tag: a,b\r\n\r\n", "<html></html>")
+
+	entry, err := ParseEntry(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Key != "httpsexample.com/" {
+		t.Fatalf("unexpected key %q", entry.Key)
+	}
+	if entry.Status != 404 {
+		t.Fatalf("unexpected status %d", entry.Status)
+	}
+	if entry.Headers.Get("Content-Type") != "text/html; charset=utf-8" || entry.Headers.Get("Cache-Tag") != "a,b" {
+		t.Fatalf("unexpected headers %v", entry.Headers)
+	}
+	if entry.Etag != `"abc"` {
+		t.Fatalf("unexpected etag %q", entry.Etag)
+	}
+	if !entry.Date.Equal(date) || !entry.ValidSec.Equal(date.Add(time.Hour)) {
+		t.Fatalf("unexpected dates %s, %s", entry.Date, entry.ValidSec)
+	}
+	if entry.Expired(date.Add(30*time.Minute)) || !entry.Expired(date.Add(2*time.Hour)) {
+		t.Fatal("unexpected expiry")
+	}
+}
+
+func TestParseEntryFastcgi(t *testing.T) {
+	date := time.Unix(1700000000, 0)
+	headers := "\x01\x06\x00\x01\x00\x40\x00\x00Status: 301 Moved Permanently\r\nContent-type: text/plain\r\n\r\n"
+	entry, err := ParseEntry(testEntry("GET/", date, date, headers, ""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Status != 301 || entry.Headers.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
+
+func TestParseEntryInvalid(t *testing.T) {
+	date := time.Unix(1700000000, 0)
+	content := testEntry("key", date, date, "HTTP/1.1 200 OK\r\n\r\n", "")
+	content[0] = 4
+	if _, err := ParseEntry(content); err == nil {
+		t.Fatal("expected an unsupported version to be rejected")
+	}
+	if _, err := ParseEntry(content[:100]); err == nil {
+		t.Fatal("expected a truncated header to be rejected")
+	}
+}
+
+func TestWalkEntries(t *testing.T) {
+	root := t.TempDir()
+	date := time.Unix(1700000000, 0)
+	entryPath := filepath.Join(root, "c", "29", "b7f54b2df7773722d382f4809d65029c")
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(entryPath, testEntry("key", date, date, "HTTP/1.1 200 OK\r\n\r\n", "body"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(entryPath+".0000000001", []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make([]*Entry, 0)
+	err := WalkEntries(root, func(path string, entry *Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != entryPath || entries[0].Key != "key" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if info, _ := os.Stat(entryPath); entries[0].Size != info.Size() {
+		t.Fatalf("unexpected size %d", entries[0].Size)
+	}
+}
+
+func TestBuildCachePath(t *testing.T) {
+	roots := map[string]string{"in_mem": "/dev/shm/nginx", "on_disk": "/var/cache/nginx"}
+	got, err := BuildCachePath("proxy", "myapp", file_config.CacheConfig{Name: "pages", InMem: true}, roots)
+	if err != nil || got != "/dev/shm/nginx/proxy_myapp_pages" {
+		t.Fatalf("unexpected path %s, %v", got, err)
+	}
+	got, err = BuildCachePath("fastcgi", "myapp", file_config.CacheConfig{Name: "php"}, roots)
+	if err != nil || got != "/var/cache/nginx/fastcgi_myapp_php" {
+		t.Fatalf("unexpected path %s, %v", got, err)
+	}
+	if _, err := BuildCachePath("proxy", "", file_config.CacheConfig{Name: "pages"}, roots); err == nil {
+		t.Fatal("expected a missing app name to be rejected")
+	}
+}
+
+func TestParseCacheDefaultFlags(t *testing.T) {
+	flags := ParseCacheDefaultFlags("levels=1:2  max_size=1g use_temp_path=off\tinactive")
+	expected := map[string]string{"levels": "1:2", "max_size": "1g", "use_temp_path": "off", "inactive": ""}
+	if len(flags) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, flags)
+	}
+	for k, v := range expected {
+		if flags[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, flags[k])
+		}
+	}
+}
+
+func TestLoadCacheRoots(t *testing.T) {
+	t.Setenv("PROXY_CACHE_IN_MEM_ROOT_PATH", "/dev/shm/nginx")
+	t.Setenv("PROXY_CACHE_ON_DISK_ROOT_PATH", "/var/cache/nginx")
+	t.Setenv("FASTCGI_CACHE_IN_MEM_ROOT_PATH", "/dev/shm/fastcgi")
+	t.Setenv("FASTCGI_CACHE_ON_DISK_ROOT_PATH", "")
+
+	if roots := LoadCacheRoots("proxy"); roots["in_mem"] != "/dev/shm/nginx" || roots["on_disk"] != "/var/cache/nginx" {
+		t.Errorf("unexpected proxy roots %v", roots)
+	}
+	roots := LoadCacheRoots("fastcgi")
+	if roots["in_mem"] != "/dev/shm/fastcgi" {
+		t.Errorf("unexpected fastcgi roots %v", roots)
+	}
+	if _, err := BuildCachePath("fastcgi", "myapp", file_config.CacheConfig{Name: "php"}, roots); err == nil {
+		t.Errorf("expected a missing on_disk root to be rejected")
+	}
+}